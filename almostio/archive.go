@@ -0,0 +1,191 @@
+package almostio
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Metadata that tar headers cannot keep is saved as PAX records.
+const (
+	paxSha256     = "ALMOSTIO.sha256"
+	paxMime       = "ALMOSTIO.mime"
+	paxCreated    = "ALMOSTIO.created"
+	paxIncomplete = "ALMOSTIO.incomplete"
+	paxAttributes = "ALMOSTIO.attributes"
+)
+
+// ExportOptions selects the files to export.
+type ExportOptions struct {
+	// Prefix limits the export to the files which names start with it.
+	Prefix string
+	// Since limits the export to the files modified after it, deletions are not exported. Zero
+	// value exports all files, including the ones without the modification time.
+	Since time.Time
+}
+
+// Export writes the files as a tar stream with the names from the metadata. The sha256, the
+// timestamps and the attributes are kept in the headers, so Import restores them. Local overlays
+// are exported without updating the access times.
+func Export(o Overlay, w io.Writer, options ExportOptions) error {
+	open := func(md *FileMetadata) (io.ReadCloser, error) {
+		return o.OpenRead(md.Name)
+	}
+	if vo, ok := o.(verifiable); ok {
+		open = vo.openLocal
+	}
+
+	tw := tar.NewWriter(w)
+	for _, md := range o.List(options.Prefix) {
+		if !options.Since.IsZero() && !md.Modified.After(options.Since) {
+			continue
+		}
+		if err := exportFile(tw, md, open); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("cannot export %q: %w", md.Name, err)
+		}
+	}
+	return tw.Close()
+}
+
+func exportFile(tw *tar.Writer, md *FileMetadata, open func(*FileMetadata) (io.ReadCloser, error)) error {
+	r, err := open(md)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	records := map[string]string{
+		paxSha256:  md.Sha256,
+		paxMime:    md.Mime,
+		paxCreated: md.Created.Format(time.RFC3339Nano),
+	}
+	if md.Incomplete {
+		records[paxIncomplete] = strconv.FormatBool(md.Incomplete)
+	}
+	if md.Attributes != nil {
+		attributes, err := json.Marshal(md.Attributes)
+		if err != nil {
+			return err
+		}
+		records[paxAttributes] = string(attributes)
+	}
+
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       md.Name,
+		Size:       md.Size,
+		Mode:       defaultPermissions,
+		ModTime:    md.Modified,
+		AccessTime: md.Accessed,
+		PAXRecords: records,
+		Format:     tar.FormatPAX,
+	}); err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, r, md.Size)
+	return err
+}
+
+// Import writes the files from the tar stream like OpenWrite does. Each file is checked
+// against the sha256 saved by Export before it is written, stops on the first mismatch. Entries
+// other than regular files are skipped.
+func Import(o Overlay, r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := importFile(o, tr, header); err != nil {
+			return fmt.Errorf("cannot import %q: %w", header.Name, err)
+		}
+	}
+}
+
+func importFile(o Overlay, r io.Reader, header *tar.Header) error {
+	options, err := importOptions(header)
+	if err != nil {
+		return err
+	}
+
+	// The content is kept aside until checked, so a broken file does not replace a good one
+	spool, err := os.CreateTemp("", "overlay-import-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	sha := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(spool, sha), r); err != nil {
+		return err
+	}
+	if expected, ok := header.PAXRecords[paxSha256]; ok && expected != fmt.Sprintf("%x", sha.Sum(nil)) {
+		return fmt.Errorf("sha256 mismatch, expected %s", expected)
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	w, err := o.OpenWrite(header.Name, options...)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, spool); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// importOptions restores the metadata saved in the tar header.
+func importOptions(header *tar.Header) ([]WriteOption, error) {
+	options := []WriteOption{}
+	if !header.ModTime.IsZero() {
+		timestamps := &FileMetadata{
+			Created:  header.ModTime,
+			Modified: header.ModTime,
+			Accessed: header.AccessTime,
+		}
+		if timestamps.Accessed.IsZero() {
+			timestamps.Accessed = header.ModTime
+		}
+		if created, ok := header.PAXRecords[paxCreated]; ok {
+			parsed, err := time.Parse(time.RFC3339Nano, created)
+			if err != nil {
+				return nil, err
+			}
+			timestamps.Created = parsed
+		}
+		options = append(options, withTimestamps(timestamps))
+	}
+
+	if mime, ok := header.PAXRecords[paxMime]; ok {
+		options = append(options, WithContentType(mime))
+	}
+	if incomplete, ok := header.PAXRecords[paxIncomplete]; ok {
+		parsed, err := strconv.ParseBool(incomplete)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, withIncomplete(parsed))
+	}
+	if attributes, ok := header.PAXRecords[paxAttributes]; ok {
+		parsed := map[string]string{}
+		if err := json.Unmarshal([]byte(attributes), &parsed); err != nil {
+			return nil, err
+		}
+		options = append(options, WithAttributes(parsed))
+	}
+	return options, nil
+}
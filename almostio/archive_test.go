@@ -0,0 +1,176 @@
+package almostio
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func archiveNames(t *testing.T, archive []byte) []string {
+	names := []string{}
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return names
+		} else if err != nil {
+			t.Fatalf("Cannot read archive: %v", err)
+		}
+		names = append(names, header.Name)
+	}
+}
+
+func TestArchive(t *testing.T) {
+
+	t.Run("Import restores exported files", func(t *testing.T) {
+		clock := newFakeClock()
+		src := newTestOverlay(t, "", withClock(clock))
+		writeOverlayFile(src, "http://example.com/index.html", []byte("<html></html>"))
+		clock.Advance(time.Hour)
+		src.SetAttributes("http://example.com/index.html", map[string]string{"etag": "123"})
+		writeOverlayFile(src, "Binary", []byte{1, 2, 3})
+		w := must(src.OpenAppend("Partial"))
+		w.Write([]byte("Part"))
+		w.Close()
+
+		archive := &bytes.Buffer{}
+		if err := Export(src, archive, ExportOptions{}); err != nil {
+			t.Fatalf("Cannot export: %v", err)
+		}
+		if names := archiveNames(t, archive.Bytes()); !reflect.DeepEqual(names, []string{
+			"Binary", "Partial", "http://example.com/index.html",
+		}) {
+			t.Errorf("Expected logical names in archive, but got %v", names)
+		}
+
+		dst := NewMemoryOverlay()
+		if err := Import(dst, bytes.NewReader(archive.Bytes())); err != nil {
+			t.Fatalf("Cannot import: %v", err)
+		}
+		for _, md := range src.List("") {
+			imported := dst.GetMetadata([]string{md.Name})[0]
+			if imported == nil {
+				t.Errorf("Expected %s to be imported", md.Name)
+				continue
+			}
+			if imported.Sha256 != md.Sha256 || imported.Mime != md.Mime || imported.Incomplete != md.Incomplete ||
+				!reflect.DeepEqual(imported.Attributes, md.Attributes) {
+				t.Errorf("Expected imported metadata %v, but got %v", md, imported)
+			}
+			if !imported.Created.Equal(md.Created) || !imported.Modified.Equal(md.Modified) ||
+				!imported.Accessed.Equal(md.Accessed) {
+				t.Errorf("Expected timestamps of %s to be kept, but got %v", md.Name, imported)
+			}
+		}
+		if got := must(readOverlayFile(dst, "Binary")); !bytes.Equal(got, []byte{1, 2, 3}) {
+			t.Errorf("Expected imported content, but got %v", got)
+		}
+	})
+
+	t.Run("Incremental export", func(t *testing.T) {
+		clock := newFakeClock()
+		o := newTestOverlay(t, "", withClock(clock))
+		writeOverlayFile(o, "Old", []byte("old"))
+		clock.Advance(time.Hour)
+		since := clock.Now()
+		writeOverlayFile(o, "Prefix/New", []byte("new"))
+		writeOverlayFile(o, "New", []byte("new"))
+
+		archive := &bytes.Buffer{}
+		Export(o, archive, ExportOptions{Since: since.Add(-time.Minute)})
+		if names := archiveNames(t, archive.Bytes()); !reflect.DeepEqual(names, []string{"New", "Prefix/New"}) {
+			t.Errorf("Expected only new files, but got %v", names)
+		}
+
+		archive.Reset()
+		Export(o, archive, ExportOptions{Prefix: "Prefix/", Since: since.Add(-time.Minute)})
+		if names := archiveNames(t, archive.Bytes()); !reflect.DeepEqual(names, []string{"Prefix/New"}) {
+			t.Errorf("Expected only new files with prefix, but got %v", names)
+		}
+	})
+
+	t.Run("Export does not change the overlay", func(t *testing.T) {
+		clock := newFakeClock()
+		o := newTestOverlay(t, "", withClock(clock), WithCodecs(NewGzipCodec(gzip.DefaultCompression)),
+			WithEviction(EvictionPolicy{TTL: time.Hour}))
+		writeOverlayFile(o, "File 1", []byte("File 1"))
+		clock.Advance(2 * time.Hour)
+		before := o.GetMetadata([]string{"File 1"})[0]
+
+		archive := &bytes.Buffer{}
+		if err := Export(o, archive, ExportOptions{}); err != nil {
+			t.Fatalf("Cannot export: %v", err)
+		}
+		if after := o.GetMetadata([]string{"File 1"})[0]; after != before {
+			t.Errorf("Expected metadata %v to stay the same, but got %v", before, after)
+		}
+		dst := NewMemoryOverlay()
+		if err := Import(dst, bytes.NewReader(archive.Bytes())); err != nil {
+			t.Fatalf("Cannot import: %v", err)
+		}
+		if got, err := readOverlayFile(dst, "File 1"); err != nil || string(got) != "File 1" {
+			t.Errorf("Expected decoded content, but got %q, %v", got, err)
+		}
+	})
+
+	t.Run("Export of legacy metadata", func(t *testing.T) {
+		root := filepath.Join(t.TempDir(), "overlay_root")
+		o := must(NewLocalOverlay(root, NewJsonMarshal[OverlayMetadata]()))
+		writeOverlayFile(o, "File 1", []byte("File 1"))
+		legacy := &OverlayMetadata{
+			SchemaVersion: len(metadataUpgrades),
+			FileMetadata:  map[string]*FileMetadata{"File 1": withoutTimestamps(o.GetMetadata([]string{"File 1"})[0])},
+		}
+		if err := metadataStore(root).Save(legacy, nil); err != nil {
+			t.Fatalf("Cannot save metadata: %v", err)
+		}
+
+		archive := &bytes.Buffer{}
+		Export(must(NewLocalOverlay(root, NewJsonMarshal[OverlayMetadata]())), archive, ExportOptions{})
+		if names := archiveNames(t, archive.Bytes()); !reflect.DeepEqual(names, []string{"File 1"}) {
+			t.Errorf("Expected files without timestamps to be exported, but got %v", names)
+		}
+	})
+
+	t.Run("Import checks sha256", func(t *testing.T) {
+		src := NewMemoryOverlay()
+		writeOverlayFile(src, "A", []byte("Good"))
+		writeOverlayFile(src, "B", []byte("Good"))
+		archive := &bytes.Buffer{}
+		Export(src, archive, ExportOptions{})
+		corrupted := bytes.Replace(archive.Bytes(), []byte("Good"), []byte("Evil"), 1)
+
+		dst := NewMemoryOverlay()
+		writeOverlayFile(dst, "A", []byte("Kept"))
+		err := Import(dst, bytes.NewReader(corrupted))
+		if err == nil || !strings.Contains(err.Error(), "sha256 mismatch") {
+			t.Errorf("Expected sha256 mismatch error, but got %v", err)
+		}
+		if got := must(readOverlayFile(dst, "A")); string(got) != "Kept" {
+			t.Errorf("Expected corrupted file not to be written, but got %q", got)
+		}
+	})
+
+	t.Run("Import of plain tar", func(t *testing.T) {
+		archive := &bytes.Buffer{}
+		tw := tar.NewWriter(archive)
+		tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "dir/", Mode: 0755})
+		tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "dir/file.txt", Size: 5, Mode: 0644})
+		tw.Write([]byte("Hello"))
+		tw.Close()
+
+		o := NewMemoryOverlay()
+		if err := Import(o, archive); err != nil {
+			t.Fatalf("Cannot import: %v", err)
+		}
+		if names := listNames(o); !reflect.DeepEqual(names, []string{"dir/file.txt"}) {
+			t.Errorf("Expected only regular files, but got %v", names)
+		}
+	})
+}
@@ -0,0 +1,119 @@
+package almostio
+
+import (
+	"os"
+	"path/filepath"
+)
+
+const (
+	tempSuffix   = ".tmp"
+	backupSuffix = ".bak"
+)
+
+// syncedFile flushes the file content to the disk before closing it.
+type syncedFile struct {
+	*os.File
+}
+
+func (sf *syncedFile) Close() error {
+	if err := sf.File.Sync(); err != nil {
+		sf.File.Close()
+		return err
+	}
+	return sf.File.Close()
+}
+
+// writeFileAtomic replaces the file content so that a crash leaves either the old or the new
+// version. The previous version is kept with the backup suffix, the new one is written to the
+// file with the temp suffix first.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + tempSuffix
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, defaultPermissions)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = (&syncedFile{f}).Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(path, path+backupSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// readFileAtomic reads the file written by writeFileAtomic recovering from an interrupted write:
+// when the file is missing or cannot be parsed, the temp and then the backup versions are tried.
+// The version read is put in place if restore is true, otherwise nothing changes on disk.
+// Returns os.ErrNotExist if there are no versions at all.
+func readFileAtomic[T any](path string, parse func([]byte) (T, error), restore bool) (T, error) {
+	var result T
+	var firstErr error
+	for _, candidate := range []string{path, path + tempSuffix, path + backupSuffix} {
+		data, err := os.ReadFile(candidate)
+		if err != nil {
+			if !os.IsNotExist(err) && firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if result, err = parse(data); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if !restore {
+			return result, nil
+		}
+		if candidate != path {
+			if err := writeFileAtomic(path, data); err != nil {
+				return result, err
+			}
+		}
+		os.Remove(path + tempSuffix)
+		return result, nil
+	}
+	if firstErr == nil {
+		firstErr = os.ErrNotExist
+	}
+	return result, firstErr
+}
+
+// syncDir makes sure that renames within the folder are persisted.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	d.Sync()
+	return nil
+}
+
+// restoreFileAtomic puts the file written by writeFileAtomic back in place if the write was
+// interrupted between renames. When the file is missing, the temp version is complete, because it
+// is renamed only after it was written.
+func restoreFileAtomic(path string) error {
+	if current := currentFileAtomic(path); current != path {
+		return os.Rename(current, path)
+	}
+	return nil
+}
+
+// currentFileAtomic returns the version of the file that restoreFileAtomic puts in place: the file
+// itself or its temp or backup version, the path itself if there are no versions at all.
+func currentFileAtomic(path string) string {
+	for _, candidate := range []string{path, path + tempSuffix, path + backupSuffix} {
+		if _, err := os.Stat(candidate); !os.IsNotExist(err) {
+			return candidate
+		}
+	}
+	return path
+}
@@ -0,0 +1,101 @@
+package almostio
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func parseStrings(data []byte) ([]string, error) {
+	result := []string{}
+	return result, json.Unmarshal(data, &result)
+}
+
+func TestAtomicFile(t *testing.T) {
+
+	for _, tc := range []struct {
+		name    string
+		files   map[string]string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "Main file",
+			files: map[string]string{"": `["main"]`, tempSuffix: `["temp"]`, backupSuffix: `["backup"]`},
+			want:  "main",
+		},
+		{
+			name:  "Corrupted main file, complete temp file",
+			files: map[string]string{"": `["ma`, tempSuffix: `["temp"]`, backupSuffix: `["backup"]`},
+			want:  "temp",
+		},
+		{
+			name:  "Missing main file, incomplete temp file",
+			files: map[string]string{tempSuffix: `["te`, backupSuffix: `["backup"]`},
+			want:  "backup",
+		},
+		{
+			name:    "All files corrupted",
+			files:   map[string]string{"": `[`, tempSuffix: `[`, backupSuffix: `[`},
+			wantErr: true,
+		},
+		{
+			name:    "No files",
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "file.json")
+			for suffix, content := range tc.files {
+				os.WriteFile(path+suffix, []byte(content), defaultPermissions)
+			}
+
+			if result, err := readFileAtomic(path, parseStrings, false); tc.wantErr != (err != nil) || (err == nil && result[0] != tc.want) {
+				t.Errorf("Expected to read %q without restoring, but got %v, %v", tc.want, result, err)
+			}
+			for suffix, content := range tc.files {
+				if data, _ := os.ReadFile(path + suffix); string(data) != content {
+					t.Errorf("Expected %q not to change without restoring, but got %q", path+suffix, data)
+				}
+			}
+
+			result, err := readFileAtomic(path, parseStrings, true)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("Expected error, but got %v", result)
+				}
+				return
+			}
+			if err != nil || len(result) != 1 || result[0] != tc.want {
+				t.Errorf("Expected to read %q, but got %v, %v", tc.want, result, err)
+			}
+			if result, err = parseStrings(must(os.ReadFile(path))); err != nil || result[0] != tc.want {
+				t.Errorf("Expected main file to be restored with %q, but got %v, %v", tc.want, result, err)
+			}
+		})
+	}
+
+	t.Run("Write keeps previous version", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "file.json")
+		writeFileAtomic(path, []byte(`["first"]`))
+		writeFileAtomic(path, []byte(`["second"]`))
+
+		if data, _ := os.ReadFile(path); string(data) != `["second"]` {
+			t.Errorf("Expected file to have new content, but got %s", data)
+		}
+		if data, _ := os.ReadFile(path + backupSuffix); string(data) != `["first"]` {
+			t.Errorf("Expected backup to have previous content, but got %s", data)
+		}
+		if _, err := os.Stat(path + tempSuffix); !os.IsNotExist(err) {
+			t.Errorf("Expected temp file to be removed, but got %v", err)
+		}
+	})
+}
+
+func must[T any](v T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
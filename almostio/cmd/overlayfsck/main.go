@@ -0,0 +1,93 @@
+// Overlayfsck checks that the files in the local overlay match their metadata.
+//
+// Usage:
+//
+//	overlayfsck [-repair] [-workers N] [-log-store] [-gzip] [-aes-key-file path] <overlay root>
+package main
+
+import (
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/lanseg/golang-commons/almostio"
+)
+
+func printNames(title string, names []string) {
+	for _, name := range names {
+		fmt.Printf("%s: %s\n", title, name)
+	}
+}
+
+func readAESCodec(keyFile string) (almostio.Codec, error) {
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return almostio.NewAESGCMCodec(key)
+}
+
+func main() {
+	repair := flag.Bool("repair", false, "Remove missing files, update corrupted and add untracked files to the metadata")
+	workers := flag.Int("workers", 0, "Number of files checked in parallel, defaults to the number of CPUs")
+	logStore := flag.Bool("log-store", false, "Keep the metadata in the append-only log, roots that have the log use it anyway")
+	gzipped := flag.Bool("gzip", false, "Read files compressed with gzip")
+	aesKeyFile := flag.String("aes-key-file", "", "File with the AES-GCM key of encrypted files")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s [-repair] [-workers N] [-log-store] [-gzip] [-aes-key-file path] <overlay root>\n", os.Args[0])
+		os.Exit(2)
+	}
+
+	root := flag.Arg(0)
+	if _, err := os.Stat(root); err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot open overlay: %s\n", err)
+		os.Exit(2)
+	}
+	options := []almostio.LocalOverlayOption{}
+	if *logStore {
+		options = append(options, almostio.WithLogMetadataStore())
+	}
+	if *gzipped {
+		options = append(options, almostio.WithDecoders(almostio.NewGzipCodec(gzip.DefaultCompression)))
+	}
+	if *aesKeyFile != "" {
+		codec, err := readAESCodec(*aesKeyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot read the key: %s\n", err)
+			os.Exit(2)
+		}
+		options = append(options, almostio.WithDecoders(codec))
+	}
+	if !*repair {
+		// Checking must not upgrade the metadata or remove the writes in progress
+		options = append(options, almostio.WithReadOnly())
+	}
+	o, err := almostio.NewLocalOverlay(root, almostio.NewJsonMarshal[almostio.OverlayMetadata](), options...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot open overlay: %s\n", err)
+		os.Exit(2)
+	}
+
+	report, err := almostio.Verify(o, almostio.VerifyOptions{
+		Workers: *workers,
+		Repair:  *repair,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Verification failed: %s\n", err)
+		os.Exit(2)
+	}
+
+	printNames("Missing", report.Missing)
+	printNames("Corrupted", report.Corrupted)
+	printNames("Unreadable", report.Unreadable)
+	printNames("Orphaned", report.Orphaned)
+	printNames("Reindexed", report.Reindexed)
+	fmt.Printf("Checked %d files: %d missing, %d corrupted, %d unreadable, %d orphaned\n",
+		report.Checked, len(report.Missing), len(report.Corrupted), len(report.Unreadable), len(report.Orphaned))
+	if !report.IsClean() && !*repair {
+		os.Exit(1)
+	}
+}
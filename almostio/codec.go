@@ -0,0 +1,325 @@
+package almostio
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	codecSeparator = ","
+
+	aesGcmChunkSize   = 64 * 1024
+	aesGcmNoncePrefix = 8
+)
+
+// Codec transforms the file content when it is stored locally, e.g. compresses or encrypts it.
+type Codec interface {
+	// Name identifies the codec in the file metadata, so it must not change.
+	Name() string
+	// Encode returns a writer that writes the encoded data to w, closing it flushes the data
+	// but does not close w.
+	Encode(w io.Writer) (io.WriteCloser, error)
+	// Decode returns a reader for the decoded data from r, closing it does not close r.
+	Decode(r io.Reader) (io.ReadCloser, error)
+}
+
+// WithCodecs encodes written files with the codecs in the given order, e.g. compresses and then
+// encrypts them. The codec names are saved to the file metadata, so files written with different
+// codecs could be read as long as all the codecs are configured. Sha256, mime type and size in the
+// metadata describe the original content.
+func WithCodecs(codecs ...Codec) LocalOverlayOption {
+	return func(lo *localOverlay) {
+		lo.codecs = codecs
+		for _, codec := range codecs {
+			lo.knownCodecs[codec.Name()] = codec
+		}
+	}
+}
+
+// WithDecoders makes files written with the codecs readable without using them for new files.
+func WithDecoders(codecs ...Codec) LocalOverlayOption {
+	return func(lo *localOverlay) {
+		for _, codec := range codecs {
+			lo.knownCodecs[codec.Name()] = codec
+		}
+	}
+}
+
+func codecNames(codecs []Codec) string {
+	names := make([]string, len(codecs))
+	for i, codec := range codecs {
+		names[i] = codec.Name()
+	}
+	return strings.Join(names, codecSeparator)
+}
+
+// chainedWriteCloser closes the writer and then the one it writes to.
+type chainedWriteCloser struct {
+	io.WriteCloser
+
+	next io.Closer
+}
+
+func (cwc *chainedWriteCloser) Close() error {
+	if err := cwc.WriteCloser.Close(); err != nil {
+		cwc.next.Close()
+		return err
+	}
+	return cwc.next.Close()
+}
+
+// chainedReadCloser closes the reader and then the one it reads from.
+type chainedReadCloser struct {
+	io.ReadCloser
+
+	next io.Closer
+}
+
+func (crc *chainedReadCloser) Close() error {
+	err := crc.ReadCloser.Close()
+	if nextErr := crc.next.Close(); err == nil {
+		err = nextErr
+	}
+	return err
+}
+
+// encode wraps the writer with encoders for all the codecs.
+func encode(w io.WriteCloser, codecs []Codec) (io.WriteCloser, error) {
+	for i := len(codecs) - 1; i >= 0; i-- {
+		encoder, err := codecs[i].Encode(w)
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		w = &chainedWriteCloser{WriteCloser: encoder, next: w}
+	}
+	return w, nil
+}
+
+// checkCodecs fails if the file was written with codecs that are not configured.
+func (lo *localOverlay) checkCodecs(md *FileMetadata) error {
+	if md.Codec == "" {
+		return nil
+	}
+	for _, name := range strings.Split(md.Codec, codecSeparator) {
+		if _, ok := lo.knownCodecs[name]; !ok {
+			return fmt.Errorf("unknown codec %q for file %q", name, md.Name)
+		}
+	}
+	return nil
+}
+
+// decode wraps the reader with decoders for the codecs listed in the metadata.
+func (lo *localOverlay) decode(r io.ReadCloser, md *FileMetadata) (io.ReadCloser, error) {
+	if md.Codec == "" {
+		return r, nil
+	}
+	if err := lo.checkCodecs(md); err != nil {
+		r.Close()
+		return nil, err
+	}
+	names := strings.Split(md.Codec, codecSeparator)
+	for i := len(names) - 1; i >= 0; i-- {
+		decoder, err := lo.knownCodecs[names[i]].Decode(r)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r = &chainedReadCloser{ReadCloser: decoder, next: r}
+	}
+	return r, nil
+}
+
+type gzipCodec struct {
+	Codec
+
+	level int
+}
+
+// NewGzipCodec compresses files with gzip using the compression level from the compress/gzip.
+func NewGzipCodec(level int) Codec {
+	return &gzipCodec{
+		level: level,
+	}
+}
+
+func (gc *gzipCodec) Name() string {
+	return "gzip"
+}
+
+func (gc *gzipCodec) Encode(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, gc.level)
+}
+
+func (gc *gzipCodec) Decode(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// aesGcmCodec splits the data into chunks, each sealed with its own nonce. The last chunk is
+// authenticated differently, so truncated data cannot be decoded.
+type aesGcmCodec struct {
+	Codec
+
+	aead cipher.AEAD
+}
+
+// NewAESGCMCodec encrypts files with AES-GCM, the key must be 16, 24 or 32 bytes long.
+func NewAESGCMCodec(key []byte) (Codec, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &aesGcmCodec{
+		aead: aead,
+	}, nil
+}
+
+func (ac *aesGcmCodec) Name() string {
+	return "aes-gcm"
+}
+
+func chunkNonce(prefix []byte, chunk uint32) []byte {
+	nonce := make([]byte, len(prefix)+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[len(prefix):], chunk)
+	return nonce
+}
+
+func chunkAdditionalData(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+func (ac *aesGcmCodec) Encode(w io.Writer) (io.WriteCloser, error) {
+	prefix := make([]byte, aesGcmNoncePrefix)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(prefix); err != nil {
+		return nil, err
+	}
+	return &aesGcmWriter{
+		aead:   ac.aead,
+		writer: w,
+		prefix: prefix,
+		buffer: make([]byte, 0, aesGcmChunkSize),
+	}, nil
+}
+
+func (ac *aesGcmCodec) Decode(r io.Reader) (io.ReadCloser, error) {
+	prefix := make([]byte, aesGcmNoncePrefix)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, err
+	}
+	return &aesGcmReader{
+		aead:   ac.aead,
+		reader: bufio.NewReaderSize(r, aesGcmChunkSize+ac.aead.Overhead()+1),
+		prefix: prefix,
+		chunk:  make([]byte, aesGcmChunkSize+ac.aead.Overhead()),
+	}, nil
+}
+
+type aesGcmWriter struct {
+	io.WriteCloser
+
+	aead   cipher.AEAD
+	writer io.Writer
+	prefix []byte
+	buffer []byte
+	chunk  uint32
+}
+
+func (aw *aesGcmWriter) seal(last bool) error {
+	sealed := aw.aead.Seal(nil, chunkNonce(aw.prefix, aw.chunk), aw.buffer, chunkAdditionalData(last))
+	aw.chunk++
+	aw.buffer = aw.buffer[:0]
+	_, err := aw.writer.Write(sealed)
+	return err
+}
+
+// Write keeps a full chunk in the buffer until more data comes, because the last chunk is sealed
+// differently.
+func (aw *aesGcmWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		if len(aw.buffer) == aesGcmChunkSize {
+			if err := aw.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := min(len(b), aesGcmChunkSize-len(aw.buffer))
+		aw.buffer = append(aw.buffer, b[:n]...)
+		b = b[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (aw *aesGcmWriter) Close() error {
+	return aw.seal(true)
+}
+
+type aesGcmReader struct {
+	io.ReadCloser
+
+	aead    cipher.AEAD
+	reader  *bufio.Reader
+	prefix  []byte
+	chunk   []byte
+	index   uint32
+	decoded *bytes.Reader
+	done    bool
+}
+
+func (ar *aesGcmReader) nextChunk() error {
+	n, err := io.ReadFull(ar.reader, ar.chunk)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	last := err == io.ErrUnexpectedEOF
+	if !last {
+		_, peekErr := ar.reader.Peek(1)
+		last = peekErr == io.EOF
+	}
+	data, err := ar.aead.Open(nil, chunkNonce(ar.prefix, ar.index), ar.chunk[:n], chunkAdditionalData(last))
+	if err != nil {
+		return err
+	}
+	ar.index++
+	ar.done = last
+	ar.decoded = bytes.NewReader(data)
+	return nil
+}
+
+func (ar *aesGcmReader) Read(b []byte) (int, error) {
+	for ar.decoded == nil || ar.decoded.Len() == 0 {
+		if ar.done {
+			return 0, io.EOF
+		}
+		if err := ar.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+	return ar.decoded.Read(b)
+}
+
+func (ar *aesGcmReader) Close() error {
+	return nil
+}
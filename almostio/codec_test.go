@@ -0,0 +1,173 @@
+package almostio
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCodecs(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	aesGcm := must(NewAESGCMCodec(key))
+	gz := NewGzipCodec(gzip.BestCompression)
+
+	text := bytes.Repeat([]byte("<html><body>Hello world</body></html>\n"), 1000)
+	random := make([]byte, 3*aesGcmChunkSize+17)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	for _, tc := range []struct {
+		name   string
+		codecs []Codec
+	}{
+		{name: "gzip", codecs: []Codec{gz}},
+		{name: "aes-gcm", codecs: []Codec{aesGcm}},
+		{name: "gzip then aes-gcm", codecs: []Codec{gz, aesGcm}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root := filepath.Join(t.TempDir(), "overlay_root")
+			o := newTestOverlay(t, root, WithCodecs(tc.codecs...))
+
+			for name, content := range map[string][]byte{
+				"Text":   text,
+				"Random": random,
+				"Empty":  {},
+			} {
+				if err := writeOverlayFile(o, name, content); err != nil {
+					t.Fatalf("Cannot write %s: %v", name, err)
+				}
+				if got := must(readOverlayFile(o, name)); !bytes.Equal(got, content) {
+					t.Errorf("Expected %s to be decoded, but got %d bytes", name, len(got))
+				}
+
+				md := o.GetMetadata([]string{name})[0]
+				if md.Sha256 != fmt.Sprintf("%x", sha256.Sum256(content)) || md.Size != int64(len(content)) {
+					t.Errorf("Expected metadata of the original content, but got %v", md)
+				}
+				if md.Codec != codecNames(tc.codecs) {
+					t.Errorf("Expected codec %q, but got %q", codecNames(tc.codecs), md.Codec)
+				}
+				local := must(os.ReadFile(filepath.Join(root, md.LocalName)))
+				if len(content) > 0 && bytes.Equal(local, content) {
+					t.Errorf("Expected local file for %s to be encoded", name)
+				}
+
+				r := must(o.OpenSeekable(name))
+				if _, err := r.Seek(int64(len(content)/2), io.SeekStart); err != nil {
+					t.Errorf("Cannot seek encoded file: %v", err)
+				}
+				if rest := must(io.ReadAll(r)); !bytes.Equal(rest, content[len(content)/2:]) {
+					t.Errorf("Expected seekable reader to return decoded content")
+				}
+				r.Close()
+			}
+			if md := o.GetMetadata([]string{"Text"})[0]; md.Mime != "text/html; charset=utf-8" {
+				t.Errorf("Expected mime type of the original content, but got %q", md.Mime)
+			}
+		})
+	}
+
+	t.Run("Files with different codecs are readable", func(t *testing.T) {
+		root := filepath.Join(t.TempDir(), "overlay_root")
+		o := newTestOverlay(t, root)
+		writeOverlayFile(o, "Plain", text)
+
+		o = newTestOverlay(t, root, WithCodecs(gz))
+		writeOverlayFile(o, "Compressed", text)
+
+		o = newTestOverlay(t, root, WithCodecs(aesGcm), WithDecoders(gz))
+		writeOverlayFile(o, "Encrypted", text)
+		for _, name := range []string{"Plain", "Compressed", "Encrypted"} {
+			if got, err := readOverlayFile(o, name); err != nil || !bytes.Equal(got, text) {
+				t.Errorf("Expected %s to be readable, but got error %v", name, err)
+			}
+		}
+
+		o = newTestOverlay(t, root)
+		if _, err := readOverlayFile(o, "Compressed"); err == nil {
+			t.Errorf("Expected error for unknown codec")
+		}
+	})
+
+	t.Run("Repair needs all codecs", func(t *testing.T) {
+		root := filepath.Join(t.TempDir(), "overlay_root")
+		writeOverlayFile(newTestOverlay(t, root, WithCodecs(gz)), "Compressed", text)
+		writeOverlayFile(newTestOverlay(t, root), "Plain", text)
+
+		o := newTestOverlay(t, root)
+		if report, err := Verify(o, VerifyOptions{}); err != nil || !reflect.DeepEqual(report.Unreadable, []string{"Compressed"}) {
+			t.Errorf("Expected compressed file to be unreadable, but got %v, %v", report, err)
+		}
+		if _, err := Verify(o, VerifyOptions{Repair: true}); err == nil {
+			t.Errorf("Expected repair to fail without the codec")
+		}
+
+		o = newTestOverlay(t, root, WithDecoders(gz))
+		if names := listNames(o); !reflect.DeepEqual(names, []string{"Compressed", "Plain"}) {
+			t.Errorf("Expected files to be kept, but got %v", names)
+		}
+		if report, err := Verify(o, VerifyOptions{Repair: true}); err != nil || !report.IsClean() {
+			t.Errorf("Expected clean overlay with the codec, but got %v, %v", report, err)
+		}
+	})
+
+	t.Run("Wrong key fails to decrypt", func(t *testing.T) {
+		root := filepath.Join(t.TempDir(), "overlay_root")
+		o := newTestOverlay(t, root, WithCodecs(aesGcm))
+		writeOverlayFile(o, "File", text)
+
+		otherKey := must(NewAESGCMCodec([]byte("fedcba9876543210fedcba9876543210")))
+		o = newTestOverlay(t, root, WithCodecs(otherKey))
+		if _, err := readOverlayFile(o, "File"); err == nil {
+			t.Errorf("Expected error for the wrong key")
+		}
+	})
+
+	t.Run("Truncated data fails to decrypt", func(t *testing.T) {
+		root := filepath.Join(t.TempDir(), "overlay_root")
+		o := newTestOverlay(t, root, WithCodecs(aesGcm))
+		writeOverlayFile(o, "File", random)
+
+		local := filepath.Join(root, o.GetMetadata([]string{"File"})[0].LocalName)
+		data := must(os.ReadFile(local))
+		chunk := aesGcmChunkSize + 16
+		os.WriteFile(local, data[:aesGcmNoncePrefix+2*chunk], defaultPermissions)
+		if _, err := readOverlayFile(o, "File"); err == nil {
+			t.Errorf("Expected error for the truncated file")
+		}
+	})
+
+	t.Run("Appending to encoded file", func(t *testing.T) {
+		o := newTestOverlay(t, "", WithCodecs(gz, aesGcm))
+		writeOverlayFile(o, "File", []byte("Hello "))
+
+		w := must(o.OpenAppend("File"))
+		w.Write([]byte("world"))
+		w.Close()
+		if got := must(readOverlayFile(o, "File")); string(got) != "Hello world" {
+			t.Errorf("Expected appended content, but got %q", got)
+		}
+	})
+
+	t.Run("Content addressed local names depend on codec", func(t *testing.T) {
+		root := filepath.Join(t.TempDir(), "overlay_root")
+		o := must(NewContentAddressedOverlay(root, NewJsonMarshal[OverlayMetadata]()))
+		writeOverlayFile(o, "Plain", text)
+		o = must(NewContentAddressedOverlay(root, NewJsonMarshal[OverlayMetadata](), WithCodecs(gz)))
+		writeOverlayFile(o, "Compressed", text)
+
+		md := o.GetMetadata([]string{"Plain", "Compressed"})
+		if md[0].LocalName == md[1].LocalName {
+			t.Errorf("Expected differently encoded files to use different local files")
+		}
+		if report := must(Verify(o, VerifyOptions{})); !report.IsClean() {
+			t.Errorf("Expected verification to decode files, but got %v", report)
+		}
+	})
+}
@@ -0,0 +1,209 @@
+package almostio
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	concurrentWorkers    = 8
+	concurrentIterations = 50
+)
+
+// payload returns a content which is easy to recognize and long enough to be written in parts.
+func payload(worker int, iteration int) []byte {
+	return bytes.Repeat([]byte(fmt.Sprintf("worker %d iteration %d;", worker, iteration)), 100)
+}
+
+func isPayload(data []byte) bool {
+	for w := range concurrentWorkers {
+		for i := range concurrentIterations {
+			if bytes.Equal(data, payload(w, i)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func runConcurrently(workers int, f func(worker int)) {
+	wg := sync.WaitGroup{}
+	wg.Add(workers)
+	for w := range workers {
+		go func() {
+			defer wg.Done()
+			f(w)
+		}()
+	}
+	wg.Wait()
+}
+
+func TestConcurrentAccess(t *testing.T) {
+
+	for _, tc := range []struct {
+		name       string
+		newOverlay func(t *testing.T) Overlay
+	}{
+		{
+			name: "Local overlay",
+			newOverlay: func(t *testing.T) Overlay {
+				return newTestOverlay(t, "")
+			},
+		},
+		{
+			name: "Content addressed overlay",
+			newOverlay: func(t *testing.T) Overlay {
+				o, err := NewContentAddressedOverlay(filepath.Join(t.TempDir(), "overlay_root"), NewJsonMarshal[OverlayMetadata]())
+				if err != nil {
+					t.Fatalf("Error while starting an overlay: %v", err)
+				}
+				return o
+			},
+		},
+		{
+			name: "Log metadata overlay",
+			newOverlay: func(t *testing.T) Overlay {
+				return newTestOverlay(t, "", WithLogMetadataStore())
+			},
+		},
+		{
+			name: "Memory overlay",
+			newOverlay: func(t *testing.T) Overlay {
+				return NewMemoryOverlay()
+			},
+		},
+	} {
+		t.Run(tc.name+": writers of the same file, last close wins", func(t *testing.T) {
+			o := tc.newOverlay(t)
+			writers := make([]*bytes.Buffer, concurrentWorkers)
+			runConcurrently(concurrentWorkers, func(w int) {
+				for i := range concurrentIterations {
+					if err := writeOverlayFile(o, "shared", payload(w, i)); err != nil {
+						t.Errorf("Cannot write file: %s", err)
+					}
+				}
+				writers[w] = bytes.NewBuffer(payload(w, concurrentIterations-1))
+			})
+
+			data, err := readOverlayFile(o, "shared")
+			if err != nil || !isPayload(data) {
+				t.Fatalf("Expected to read one of the written payloads, but got %v", err)
+			}
+			md := o.GetMetadata([]string{"shared"})[0]
+			if md.Sha256 != fmt.Sprintf("%x", sha256.Sum256(data)) || md.Size != int64(len(data)) {
+				t.Errorf("Expected metadata to describe the last written content, but got %v", md)
+			}
+			lastWritten := false
+			for _, w := range writers {
+				lastWritten = lastWritten || bytes.Equal(w.Bytes(), data)
+			}
+			if !lastWritten {
+				t.Errorf("Expected content to be the last payload of one of the writers")
+			}
+		})
+
+		t.Run(tc.name+": readers never see partial writes", func(t *testing.T) {
+			o := tc.newOverlay(t)
+			writeOverlayFile(o, "shared", payload(0, 0))
+			runConcurrently(concurrentWorkers, func(w int) {
+				for i := range concurrentIterations {
+					if w%2 == 0 {
+						wc, _ := o.OpenWrite("shared")
+						data := payload(w, i)
+						wc.Write(data[:len(data)/2])
+						wc.Write(data[len(data)/2:])
+						wc.Close()
+						continue
+					}
+					if data, err := readOverlayFile(o, "shared"); err != nil || !isPayload(data) {
+						t.Errorf("Expected to read a complete payload, but got %d bytes, %v", len(data), err)
+					}
+					o.GetMetadata([]string{"shared"})
+					o.List("")
+				}
+			})
+		})
+
+		t.Run(tc.name+": mixed operations keep metadata consistent", func(t *testing.T) {
+			o := tc.newOverlay(t)
+			runConcurrently(concurrentWorkers, func(w int) {
+				for i := range concurrentIterations {
+					name := fmt.Sprintf("file %d", i%5)
+					switch (w + i) % 5 {
+					case 0, 1:
+						writeOverlayFile(o, name, payload(w, i))
+					case 2:
+						o.Delete(name)
+					case 3:
+						o.Rename(name, fmt.Sprintf("file %d", (i+1)%5))
+					case 4:
+						o.SetAttributes(name, map[string]string{"worker": fmt.Sprint(w)})
+						readOverlayFile(o, name)
+					}
+				}
+			})
+
+			for _, md := range o.List("") {
+				data, err := readOverlayFile(o, md.Name)
+				if err != nil || !isPayload(data) {
+					t.Errorf("Expected %s to have a complete payload, but got %v", md.Name, err)
+					continue
+				}
+				if md.Sha256 != fmt.Sprintf("%x", sha256.Sum256(data)) {
+					t.Errorf("Expected metadata of %s to match the content", md.Name)
+				}
+			}
+			if report, err := Verify(o, VerifyOptions{}); err != nil || !report.IsClean() {
+				t.Errorf("Expected overlay to be clean after concurrent operations, but got %v, %v", report, err)
+			}
+		})
+	}
+}
+
+func TestConcurrentReads(t *testing.T) {
+
+	t.Run("Readers share the lock", func(t *testing.T) {
+		o := newTestOverlay(t, "")
+		writeOverlayFile(o, "File 1", []byte("File 1"))
+		o.lock.RLock()
+		defer o.lock.RUnlock()
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := readOverlayFile(o, "File 1")
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Cannot read file: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("Expected read not to wait for other readers")
+		}
+	})
+
+	t.Run("Access times are saved with the next change", func(t *testing.T) {
+		clock := newFakeClock()
+		o := newTestOverlay(t, "", withClock(clock))
+		writeOverlayFile(o, "File 1", []byte("File 1"))
+		clock.Advance(time.Hour)
+		runConcurrently(concurrentWorkers, func(worker int) {
+			readOverlayFile(o, "File 1")
+		})
+		if md := o.GetMetadata([]string{"File 1"})[0]; !md.Accessed.Equal(clock.Now()) {
+			t.Errorf("Expected access time %v, but got %v", clock.Now(), md.Accessed)
+		}
+
+		writeOverlayFile(o, "File 2", []byte("File 2"))
+		reopened := newTestOverlay(t, o.root)
+		if md := reopened.GetMetadata([]string{"File 1"})[0]; !md.Accessed.Equal(clock.Now()) {
+			t.Errorf("Expected saved access time %v, but got %v", clock.Now(), md.Accessed)
+		}
+	})
+}
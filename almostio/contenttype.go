@@ -0,0 +1,181 @@
+package almostio
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+const (
+	textPlain   = "text/plain; charset=utf-8"
+	octetStream = "application/octet-stream"
+)
+
+// ContentTypeDetector chooses the mime type of the written file.
+type ContentTypeDetector interface {
+	// DetectContentType returns the mime type for the file with the given name and the first 512
+	// bytes of the content.
+	DetectContentType(name string, head []byte) string
+}
+
+// WithContentTypeDetector sets the detector for the mime types of the written files.
+func WithContentTypeDetector(detector ContentTypeDetector) LocalOverlayOption {
+	return func(lo *localOverlay) {
+		lo.detector = detector
+	}
+}
+
+// WithContentType sets the mime type of the written file instead of detecting it.
+func WithContentType(mime string) WriteOption {
+	return func(wo *writeOptions) {
+		wo.contentType = mime
+	}
+}
+
+// detectWith returns a function that detects the mime type of the file, the type from the write
+// options takes precedence.
+func (wo *writeOptions) detectWith(detector ContentTypeDetector, name string) func([]byte) string {
+	return func(head []byte) string {
+		if wo.contentType != "" {
+			return wo.contentType
+		}
+		return detector.DetectContentType(name, head)
+	}
+}
+
+type httpContentTypeDetector struct {
+	ContentTypeDetector
+}
+
+// NewHTTPContentTypeDetector detects the mime type with http.DetectContentType, this is the
+// default detector.
+func NewHTTPContentTypeDetector() ContentTypeDetector {
+	return &httpContentTypeDetector{}
+}
+
+func (hd *httpContentTypeDetector) DetectContentType(name string, head []byte) string {
+	return http.DetectContentType(head)
+}
+
+type signature struct {
+	offset int
+	prefix []byte
+	mime   string
+}
+
+var signatures = []signature{
+	{0, []byte("\x1f\x8b"), "application/gzip"},
+	{0, []byte("BZh"), "application/x-bzip2"},
+	{0, []byte("\xfd7zXZ\x00"), "application/x-xz"},
+	{0, []byte("7z\xbc\xaf\x27\x1c"), "application/x-7z-compressed"},
+	{0, []byte("\x28\xb5\x2f\xfd"), "application/zstd"},
+	{0, []byte("Rar!\x1a\x07"), "application/vnd.rar"},
+	{0, []byte("PK\x03\x04"), "application/zip"},
+	{257, []byte("ustar"), "application/x-tar"},
+	{0, []byte("\x00asm"), "application/wasm"},
+}
+
+var extensionHints = map[string]string{
+	".json":     "application/json",
+	".md":       "text/markdown; charset=utf-8",
+	".markdown": "text/markdown; charset=utf-8",
+	".svg":      "image/svg+xml",
+	".csv":      "text/csv; charset=utf-8",
+	".yaml":     "application/yaml",
+	".yml":      "application/yaml",
+	".js":       "text/javascript; charset=utf-8",
+	".mjs":      "text/javascript; charset=utf-8",
+	".css":      "text/css; charset=utf-8",
+	".html":     "text/html; charset=utf-8",
+	".htm":      "text/html; charset=utf-8",
+	".xml":      "text/xml; charset=utf-8",
+	".txt":      textPlain,
+	".gz":       "application/gzip",
+	".tgz":      "application/gzip",
+	".bz2":      "application/x-bzip2",
+	".xz":       "application/x-xz",
+	".7z":       "application/x-7z-compressed",
+	".zst":      "application/zstd",
+	".rar":      "application/vnd.rar",
+	".zip":      "application/zip",
+	".tar":      "application/x-tar",
+	".wasm":     "application/wasm",
+	".webp":     "image/webp",
+}
+
+type extendedContentTypeDetector struct {
+	ContentTypeDetector
+}
+
+// NewExtendedContentTypeDetector recognizes more formats than http.DetectContentType: JSON, SVG,
+// WebP and archives by the content, Markdown, YAML, CSV and others by the extension of the name
+// or of the url path. The extension is used only when the content does not have a known signature.
+func NewExtendedContentTypeDetector() ContentTypeDetector {
+	return &extendedContentTypeDetector{}
+}
+
+func (ed *extendedContentTypeDetector) DetectContentType(name string, head []byte) string {
+	for _, s := range signatures {
+		if len(head) >= s.offset+len(s.prefix) && bytes.Equal(head[s.offset:s.offset+len(s.prefix)], s.prefix) {
+			return s.mime
+		}
+	}
+	if len(head) >= 12 && bytes.Equal(head[:4], []byte("RIFF")) && bytes.Equal(head[8:12], []byte("WEBP")) {
+		return "image/webp"
+	}
+
+	detected := http.DetectContentType(head)
+	if strings.HasPrefix(detected, "text/") && isSVG(head) {
+		return "image/svg+xml"
+	}
+	if detected != textPlain && detected != octetStream {
+		return detected
+	}
+	if hint, ok := extensionHints[strings.ToLower(path.Ext(namePath(name)))]; ok {
+		return hint
+	}
+	if detected == textPlain && isJSON(head) {
+		return "application/json"
+	}
+	return detected
+}
+
+// namePath returns the path of the url or the name itself if it is not a url.
+func namePath(name string) string {
+	if u, err := url.Parse(name); err == nil && u.Host != "" {
+		return u.Path
+	}
+	return name
+}
+
+// isSVG checks if the root element of the xml is svg, skipping the declarations and comments.
+func isSVG(head []byte) bool {
+	rest := bytes.TrimSpace(head)
+	for bytes.HasPrefix(rest, []byte("<?")) || bytes.HasPrefix(rest, []byte("<!")) {
+		end := bytes.IndexByte(rest, '>')
+		if end < 0 {
+			return false
+		}
+		rest = bytes.TrimSpace(rest[end+1:])
+	}
+	return bytes.HasPrefix(rest, []byte("<svg"))
+}
+
+// isJSON checks if the head is a valid beginning of a json object or array.
+func isJSON(head []byte) bool {
+	decoder := json.NewDecoder(bytes.NewReader(head))
+	token, err := decoder.Token()
+	if err != nil || (token != json.Delim('{') && token != json.Delim('[')) {
+		return false
+	}
+	for {
+		if _, err := decoder.Token(); err != nil {
+			return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package almostio
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func tarHead() []byte {
+	archive := &bytes.Buffer{}
+	tw := tar.NewWriter(archive)
+	tw.WriteHeader(&tar.Header{Name: "file.txt", Size: 1, Mode: 0644})
+	tw.Write([]byte("1"))
+	tw.Close()
+	return archive.Bytes()
+}
+
+func gzipHead() []byte {
+	compressed := &bytes.Buffer{}
+	gw := gzip.NewWriter(compressed)
+	gw.Write([]byte("Hello"))
+	gw.Close()
+	return compressed.Bytes()
+}
+
+func TestContentTypeDetector(t *testing.T) {
+	longJSON := `{"items": [` + strings.Repeat(`{"name": "item", "value": 1}, `, 50)
+
+	for _, tc := range []struct {
+		name    string
+		file    string
+		content []byte
+		want    string
+	}{
+		{name: "json object", file: "data", content: []byte(`{"key": ["value", 1, true]}`), want: "application/json"},
+		{name: "json array", file: "data", content: []byte(" [1, 2, 3]"), want: "application/json"},
+		{name: "truncated json", file: "data", content: []byte(longJSON)[:mimeBlockSize], want: "application/json"},
+		{name: "not json", file: "data", content: []byte(`{key: value}`), want: textPlain},
+		{name: "svg", file: "image", content: []byte(`<svg xmlns="http://www.w3.org/2000/svg"></svg>`), want: "image/svg+xml"},
+		{
+			name:    "svg with declaration",
+			file:    "image",
+			content: []byte("<?xml version=\"1.0\"?>\n<!-- comment -->\n<svg></svg>"),
+			want:    "image/svg+xml",
+		},
+		{name: "webp", file: "image", content: []byte("RIFF\x00\x00\x00\x00WEBPVP8 "), want: "image/webp"},
+		{name: "gzip", file: "archive", content: gzipHead(), want: "application/gzip"},
+		{name: "tar", file: "archive", content: tarHead(), want: "application/x-tar"},
+		{name: "xz", file: "archive", content: []byte("\xfd7zXZ\x00\x00"), want: "application/x-xz"},
+		{name: "7z", file: "archive", content: []byte("7z\xbc\xaf\x27\x1c\x00"), want: "application/x-7z-compressed"},
+		{name: "zstd", file: "archive", content: []byte("\x28\xb5\x2f\xfd\x00"), want: "application/zstd"},
+		{name: "markdown by extension", file: "README.md", content: []byte("# Title\n\nText"), want: "text/markdown; charset=utf-8"},
+		{
+			name:    "extension of url path",
+			file:    "https://example.com/docs/README.md?raw=true",
+			content: []byte("# Title"),
+			want:    "text/markdown; charset=utf-8",
+		},
+		{name: "signature wins over extension", file: "fake.md", content: gzipHead(), want: "application/gzip"},
+		{name: "html is kept", file: "page.md", content: []byte("<html><body></body></html>"), want: "text/html; charset=utf-8"},
+		{name: "plain text", file: "notes", content: []byte("Hello world"), want: textPlain},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := NewExtendedContentTypeDetector().DetectContentType(tc.file, tc.content); got != tc.want {
+				t.Errorf("Expected %q, but got %q", tc.want, got)
+			}
+		})
+	}
+
+	t.Run("Default detector", func(t *testing.T) {
+		o := must(NewLocalOverlay(filepath.Join(t.TempDir(), "overlay_root"), NewJsonMarshal[OverlayMetadata]()))
+		writeOverlayFile(o, "data.json", []byte(`{"key": "value"}`))
+		if md := o.GetMetadata([]string{"data.json"})[0]; md.Mime != textPlain {
+			t.Errorf("Expected http.DetectContentType by default, but got %q", md.Mime)
+		}
+	})
+
+	t.Run("Extended detector in overlay", func(t *testing.T) {
+		o := must(NewLocalOverlay(filepath.Join(t.TempDir(), "overlay_root"), NewJsonMarshal[OverlayMetadata](),
+			WithContentTypeDetector(NewExtendedContentTypeDetector())))
+		writeOverlayFile(o, "data.json", []byte(`{"key": "value"}`))
+		if md := o.GetMetadata([]string{"data.json"})[0]; md.Mime != "application/json" {
+			t.Errorf("Expected json mime type, but got %q", md.Mime)
+		}
+	})
+
+	t.Run("Explicit content type", func(t *testing.T) {
+		for _, o := range []Overlay{
+			must(NewLocalOverlay(filepath.Join(t.TempDir(), "overlay_root"), NewJsonMarshal[OverlayMetadata]())),
+			NewMemoryOverlay(),
+		} {
+			w := must(o.OpenWrite("data", WithContentType("application/vnd.custom")))
+			w.Write([]byte("Hello"))
+			w.Close()
+			if md := o.GetMetadata([]string{"data"})[0]; md.Mime != "application/vnd.custom" {
+				t.Errorf("Expected explicit mime type, but got %q", md.Mime)
+			}
+
+			writeOverlayFile(o, "data", []byte("Hello again"))
+			if md := o.GetMetadata([]string{"data"})[0]; md.Mime != textPlain {
+				t.Errorf("Expected detected mime type after overwrite, but got %q", md.Mime)
+			}
+		}
+	})
+
+	t.Run("Union overlay keeps content type", func(t *testing.T) {
+		upper := NewMemoryOverlay()
+		lower := NewMemoryOverlay()
+		w := must(lower.OpenWrite("data", WithContentType("application/vnd.custom")))
+		w.Write([]byte("Hello"))
+		w.Close()
+
+		o := NewReadThroughOverlay(upper, lower)
+		readOverlayFile(o, "data")
+		if md := upper.GetMetadata([]string{"data"})[0]; md == nil || md.Mime != "application/vnd.custom" {
+			t.Errorf("Expected copied file to keep mime type, but got %v", md)
+		}
+	})
+}
@@ -0,0 +1,136 @@
+package almostio
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// abortable is a writer that could be discarded without publishing the written data.
+type abortable interface {
+	abort()
+}
+
+// OpenReadContext opens the file for reading, reads fail with the context error once the context
+// is done.
+func OpenReadContext(ctx context.Context, o Overlay, name string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r, err := o.OpenRead(name)
+	if err != nil {
+		return nil, err
+	}
+	return &contextReader{ReadCloser: r, ctx: ctx}, nil
+}
+
+// OpenWriteContext opens the file for writing like OpenWrite. When the context is done before
+// Close, the write is aborted and the partial content is discarded, Write and Close return the
+// context error and the file keeps its previous content.
+func OpenWriteContext(ctx context.Context, o Overlay, name string, options ...WriteOption) (io.WriteCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	w, err := o.OpenWrite(name, options...)
+	if err != nil {
+		return nil, err
+	}
+	return newContextWriter(ctx, w), nil
+}
+
+// OpenAppendContext continues writing the file like OpenAppend, cancellation works like with
+// OpenWriteContext.
+func OpenAppendContext(ctx context.Context, o Overlay, name string, options ...WriteOption) (io.WriteCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	w, err := o.OpenAppend(name, options...)
+	if err != nil {
+		return nil, err
+	}
+	return newContextWriter(ctx, w), nil
+}
+
+// DeleteContext removes the file unless the context is already done.
+func DeleteContext(ctx context.Context, o Overlay, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return o.Delete(name)
+}
+
+type contextReader struct {
+	io.ReadCloser
+
+	ctx context.Context
+}
+
+func (cr *contextReader) Read(b []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.ReadCloser.Read(b)
+}
+
+// contextWriter aborts the write as soon as the context is done, even if the writer is not used
+// anymore. Writers of the overlays from this package remove their temp files, others are dropped
+// without Close, so nothing is published.
+type contextWriter struct {
+	io.WriteCloser
+
+	lock sync.Mutex
+	ctx  context.Context
+	// done is set when the writer is closed or aborted.
+	done bool
+	stop func() bool
+}
+
+func newContextWriter(ctx context.Context, w io.WriteCloser) *contextWriter {
+	cw := &contextWriter{WriteCloser: w, ctx: ctx}
+	cw.stop = context.AfterFunc(ctx, cw.abort)
+	return cw
+}
+
+func (cw *contextWriter) abort() {
+	cw.lock.Lock()
+	defer cw.lock.Unlock()
+
+	if cw.done {
+		return
+	}
+	cw.done = true
+	if a, ok := cw.WriteCloser.(abortable); ok {
+		a.abort()
+	}
+}
+
+func (cw *contextWriter) Write(b []byte) (int, error) {
+	cw.lock.Lock()
+	defer cw.lock.Unlock()
+
+	if err := cw.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if cw.done {
+		return 0, io.ErrClosedPipe
+	}
+	return cw.WriteCloser.Write(b)
+}
+
+func (cw *contextWriter) Close() error {
+	cw.stop()
+	if err := cw.ctx.Err(); err != nil {
+		// Cancelled while the writer was idle, abort might be still running
+		cw.abort()
+		return err
+	}
+
+	cw.lock.Lock()
+	defer cw.lock.Unlock()
+
+	if cw.done {
+		return io.ErrClosedPipe
+	}
+	cw.done = true
+	return cw.WriteCloser.Close()
+}
@@ -0,0 +1,148 @@
+package almostio
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempFiles(t *testing.T, root string) []os.DirEntry {
+	entries, err := os.ReadDir(filepath.Join(root, systemFolderName, tempFolderName))
+	if err != nil {
+		t.Fatalf("Cannot list temp files: %v", err)
+	}
+	return entries
+}
+
+func waitNoTempFiles(t *testing.T, root string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for len(tempFiles(t, root)) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected temp files to be removed, but got %v", tempFiles(t, root))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestContext(t *testing.T) {
+
+	newOverlay := func(t *testing.T) (Overlay, string) {
+		root := filepath.Join(t.TempDir(), "overlay_root")
+		o, err := NewLocalOverlay(root, NewJsonMarshal[OverlayMetadata]())
+		if err != nil {
+			t.Fatalf("Error while starting an overlay: %v", err)
+		}
+		writeOverlayFile(o, "File", []byte("previous content"))
+		return o, root
+	}
+
+	t.Run("Write with context", func(t *testing.T) {
+		o, _ := newOverlay(t)
+		w := must(OpenWriteContext(context.Background(), o, "File"))
+		w.Write([]byte("new content"))
+		if err := w.Close(); err != nil {
+			t.Errorf("Cannot close writer: %v", err)
+		}
+
+		if got := must(readOverlayFile(o, "File")); string(got) != "new content" {
+			t.Errorf("Expected new content, but got %q", got)
+		}
+	})
+
+	t.Run("Cancelled write is discarded", func(t *testing.T) {
+		o, root := newOverlay(t)
+		w := o.Watch("")
+		defer w.Close()
+		ctx, cancel := context.WithCancel(context.Background())
+		ow := must(OpenWriteContext(ctx, o, "File"))
+		ow.Write([]byte("partial "))
+		cancel()
+
+		if _, err := ow.Write([]byte("content")); !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected write to be cancelled, but got %v", err)
+		}
+		if err := ow.Close(); !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected close to be cancelled, but got %v", err)
+		}
+		if got := must(readOverlayFile(o, "File")); string(got) != "previous content" {
+			t.Errorf("Expected previous content, but got %q", got)
+		}
+		if events := pendingEvents(w); len(events) != 0 {
+			t.Errorf("Expected no events, but got %v", events)
+		}
+		if files := tempFiles(t, root); len(files) != 0 {
+			t.Errorf("Expected temp files to be removed, but got %v", files)
+		}
+	})
+
+	t.Run("Abandoned write is discarded on cancel", func(t *testing.T) {
+		o, root := newOverlay(t)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		defer cancel()
+		ow := must(OpenAppendContext(ctx, o, "File"))
+		ow.Write([]byte(" and more"))
+
+		waitNoTempFiles(t, root)
+		if err := ow.Close(); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected deadline error, but got %v", err)
+		}
+		if md := o.GetMetadata([]string{"File"})[0]; md.Incomplete {
+			t.Errorf("Expected file not to be touched, but got %v", md)
+		}
+		if report := must(GC(o, GCOptions{DryRun: true})); len(report.TempFiles) != 0 || len(report.Untracked) != 0 {
+			t.Errorf("Expected no garbage, but got %v", report)
+		}
+	})
+
+	t.Run("Cancelled memory write", func(t *testing.T) {
+		o := NewMemoryOverlay()
+		ctx, cancel := context.WithCancel(context.Background())
+		ow := must(OpenWriteContext(ctx, o, "File"))
+		ow.Write([]byte("content"))
+		cancel()
+		ow.Close()
+
+		if _, err := o.OpenRead("File"); !os.IsNotExist(err) {
+			t.Errorf("Expected file not to be written, but got %v", err)
+		}
+	})
+
+	t.Run("Cancelled read", func(t *testing.T) {
+		o, _ := newOverlay(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		r := must(OpenReadContext(ctx, o, "File"))
+		defer r.Close()
+		buffer := make([]byte, 8)
+		if n, err := r.Read(buffer); err != nil || string(buffer[:n]) != "previous" {
+			t.Errorf("Expected first bytes, but got %q, %v", buffer[:n], err)
+		}
+		cancel()
+
+		if _, err := io.ReadAll(r); !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected read to be cancelled, but got %v", err)
+		}
+	})
+
+	t.Run("Done context", func(t *testing.T) {
+		o, _ := newOverlay(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		if _, err := OpenReadContext(ctx, o, "File"); !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected open to fail, but got %v", err)
+		}
+		if _, err := OpenWriteContext(ctx, o, "File"); !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected open to fail, but got %v", err)
+		}
+		if err := DeleteContext(ctx, o, "File"); !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected delete to fail, but got %v", err)
+		}
+		if err := DeleteContext(context.Background(), o, "File"); err != nil {
+			t.Errorf("Cannot delete file: %v", err)
+		}
+	})
+}
@@ -0,0 +1,123 @@
+package almostio
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ErrTooLarge is returned by Close when the written file alone exceeds EvictionPolicy.MaxBytes,
+// such file would be evicted right away, so it is not written at all.
+var ErrTooLarge = errors.New("file is larger than the overlay size limit")
+
+// EvictionPolicy bounds the overlay size. When any of the limits is exceeded after a write, least
+// recently accessed files are evicted until the overlay fits. Zero values mean no limit.
+type EvictionPolicy struct {
+	// MaxBytes is the maximum total size of all files, larger files cannot be written. Previous
+	// versions count too, the oldest versions of the written file are dropped to make it fit.
+	MaxBytes int64
+	// MaxEntries is the maximum number of files.
+	MaxEntries int
+	// TTL is how long a file lives after it was modified, expired files are evicted on access
+	// or with the next write.
+	TTL time.Duration
+	// OnEvict is called for every evicted file after the eviction is saved.
+	OnEvict func(*FileMetadata)
+}
+
+// WithEviction configures the overlay to drop files according to the eviction policy.
+func WithEviction(policy EvictionPolicy) LocalOverlayOption {
+	return func(lo *localOverlay) {
+		lo.eviction = &policy
+	}
+}
+
+func (lo *localOverlay) isExpired(md *FileMetadata) bool {
+	return lo.eviction != nil && lo.eviction.TTL > 0 && lo.now().Sub(md.Modified) > lo.eviction.TTL
+}
+
+// checkSize fails if the written file does not fit into the overlay.
+func (lo *localOverlay) checkSize(md *FileMetadata) error {
+	if lo.eviction == nil || lo.eviction.MaxBytes <= 0 || md.Size <= lo.eviction.MaxBytes {
+		return nil
+	}
+	return fmt.Errorf("%w: %q has %d bytes, the limit is %d", ErrTooLarge, md.Name, md.Size, lo.eviction.MaxBytes)
+}
+
+// fitVersions drops the oldest previous versions of the written entry while the entry with its
+// versions exceeds MaxBytes, so the eviction never removes the entry that was just written.
+func (lo *localOverlay) fitVersions(fmd *FileMetadata) {
+	if lo.eviction == nil || lo.eviction.MaxBytes <= 0 {
+		return
+	}
+	for len(fmd.Versions) > 0 && entrySize(fmd) > lo.eviction.MaxBytes {
+		fmd.Versions = fmd.Versions[1:]
+	}
+	if len(fmd.Versions) == 0 {
+		fmd.Versions = nil
+	}
+}
+
+// evict removes expired entries and then the least recently accessed entries while the overlay
+// exceeds the limits. Returns the evicted entries and local files that might become unused, the
+// lock must be held by the caller.
+func (lo *localOverlay) evict() ([]*FileMetadata, []string) {
+	if lo.eviction == nil {
+		return nil, nil
+	}
+
+	candidates := []*FileMetadata{}
+	totalBytes := int64(0)
+	for _, md := range lo.metadata.FileMetadata {
+		candidates = append(candidates, md)
+		totalBytes += entrySize(md)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Accessed.Before(candidates[j].Accessed)
+	})
+
+	evicted := []*FileMetadata{}
+	unused := []string{}
+	entries := len(candidates)
+	for _, md := range candidates {
+		overLimit := (lo.eviction.MaxBytes > 0 && totalBytes > lo.eviction.MaxBytes) ||
+			(lo.eviction.MaxEntries > 0 && entries > lo.eviction.MaxEntries)
+		if !overLimit && !lo.isExpired(md) {
+			continue
+		}
+		evicted = append(evicted, md)
+		unused = append(unused, lo.setEntry(md.Name, nil)...)
+		totalBytes -= entrySize(md)
+		entries--
+	}
+	return evicted, unused
+}
+
+// expire removes the expired entry if it was not replaced since it was read, returns the removed
+// entry or nil.
+func (lo *localOverlay) expire(md *FileMetadata) (*FileMetadata, error) {
+	lo.lock.Lock()
+	defer lo.lock.Unlock()
+
+	// Recorded access times replace the entry without changing the content
+	current := lo.metadata.FileMetadata[md.Name]
+	if current == nil || current.Sha256 != md.Sha256 || !current.Modified.Equal(md.Modified) {
+		return nil, nil
+	}
+	unused := lo.setEntry(md.Name, nil)
+	if err := lo.writeMetadata(); err != nil {
+		lo.setEntry(md.Name, current)
+		return current, err
+	}
+	return current, lo.removeUnused(unused)
+}
+
+func (lo *localOverlay) notifyEvicted(evicted []*FileMetadata) {
+	for _, md := range evicted {
+		lo.watchers.notify(Event{Type: EventEvicted, Metadata: md})
+		if lo.eviction != nil && lo.eviction.OnEvict != nil {
+			lo.eviction.OnEvict(md)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package almostio
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// recordEvicted configures the eviction policy with the hook that collects the evicted names.
+func recordEvicted(policy EvictionPolicy, evicted *[]string) LocalOverlayOption {
+	policy.OnEvict = func(md *FileMetadata) {
+		*evicted = append(*evicted, md.Name)
+	}
+	return WithEviction(policy)
+}
+
+func listNames(o Overlay) []string {
+	names := []string{}
+	for _, md := range o.List("") {
+		names = append(names, md.Name)
+	}
+	return names
+}
+
+func TestEviction(t *testing.T) {
+
+	t.Run("Max entries evicts least recently used", func(t *testing.T) {
+		clock, evicted := newFakeClock(), &[]string{}
+		o := newTestOverlay(t, "", withClock(clock), recordEvicted(EvictionPolicy{MaxEntries: 2}, evicted))
+		writeOverlayFile(o, "File 1", []byte{1})
+		clock.Advance(time.Second)
+		writeOverlayFile(o, "File 2", []byte{2})
+		clock.Advance(time.Second)
+		readOverlayFile(o, "File 1")
+		clock.Advance(time.Second)
+		writeOverlayFile(o, "File 3", []byte{3})
+
+		if names := listNames(o); !reflect.DeepEqual(names, []string{"File 1", "File 3"}) {
+			t.Errorf("Expected least recently used file to be evicted, but got %v", names)
+		}
+		if !reflect.DeepEqual(*evicted, []string{"File 2"}) {
+			t.Errorf("Expected eviction hook to report [File 2], but got %v", *evicted)
+		}
+	})
+
+	t.Run("Max bytes", func(t *testing.T) {
+		clock, evicted := newFakeClock(), &[]string{}
+		o := newTestOverlay(t, "", withClock(clock), recordEvicted(EvictionPolicy{MaxBytes: 10}, evicted))
+		for _, name := range []string{"File 1", "File 2", "File 3"} {
+			writeOverlayFile(o, name, []byte("12345"))
+			clock.Advance(time.Second)
+		}
+
+		if names := listNames(o); !reflect.DeepEqual(names, []string{"File 2", "File 3"}) {
+			t.Errorf("Expected oldest file to be evicted, but got %v", names)
+		}
+		if !reflect.DeepEqual(*evicted, []string{"File 1"}) {
+			t.Errorf("Expected eviction hook to report [File 1], but got %v", *evicted)
+		}
+	})
+
+	t.Run("File over max bytes is not written", func(t *testing.T) {
+		evicted := &[]string{}
+		o := newTestOverlay(t, "", recordEvicted(EvictionPolicy{MaxBytes: 10}, evicted))
+		writeOverlayFile(o, "File 1", []byte("12345"))
+
+		if err := writeOverlayFile(o, "File 1", []byte("12345678901")); !errors.Is(err, ErrTooLarge) {
+			t.Errorf("Expected too large error, but got %v", err)
+		}
+		if err := writeOverlayFile(o, "File 2", []byte("12345678901")); !errors.Is(err, ErrTooLarge) {
+			t.Errorf("Expected too large error, but got %v", err)
+		}
+		if data, err := readOverlayFile(o, "File 1"); err != nil || string(data) != "12345" {
+			t.Errorf("Expected previous content to be kept, but got %q, %v", data, err)
+		}
+		if names := listNames(o); !reflect.DeepEqual(names, []string{"File 1"}) || len(*evicted) != 0 {
+			t.Errorf("Expected nothing to be written or evicted, but got %v, %v", names, *evicted)
+		}
+		if report := must(GC(o, GCOptions{DryRun: true})); len(report.TempFiles) != 0 || len(report.Untracked) != 0 {
+			t.Errorf("Expected no garbage, but got %v", report)
+		}
+	})
+
+	t.Run("TTL expires on read", func(t *testing.T) {
+		clock, evicted := newFakeClock(), &[]string{}
+		o := newTestOverlay(t, "", withClock(clock), recordEvicted(EvictionPolicy{TTL: time.Minute}, evicted))
+		writeOverlayFile(o, "File 1", []byte{1})
+		clock.Advance(30 * time.Second)
+		if _, err := readOverlayFile(o, "File 1"); err != nil {
+			t.Errorf("Expected file to be readable before expiration, but got %s", err)
+		}
+		clock.Advance(time.Minute)
+		if _, err := readOverlayFile(o, "File 1"); !os.IsNotExist(err) {
+			t.Errorf("Expected expired file to not exist, but got %v", err)
+		}
+		if !reflect.DeepEqual(*evicted, []string{"File 1"}) {
+			t.Errorf("Expected eviction hook to report [File 1], but got %v", *evicted)
+		}
+	})
+
+	t.Run("TTL expires on write", func(t *testing.T) {
+		clock := newFakeClock()
+		o := newTestOverlay(t, "", withClock(clock), WithEviction(EvictionPolicy{TTL: time.Minute}))
+		writeOverlayFile(o, "File 1", []byte{1})
+		clock.Advance(2 * time.Minute)
+		writeOverlayFile(o, "File 2", []byte{2})
+
+		if names := listNames(o); !reflect.DeepEqual(names, []string{"File 2"}) {
+			t.Errorf("Expected expired file to be evicted, but got %v", names)
+		}
+	})
+}
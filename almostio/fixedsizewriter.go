@@ -17,7 +17,7 @@ type fixedSizeWriter struct {
 func (fsw *fixedSizeWriter) Write(b []byte) (int, error) {
 	copySize := fsw.maxSize - fsw.written
 	if copySize <= 0 {
-		return 0, nil
+		return len(b), nil
 	}
 	if copySize > len(b) {
 		copySize = len(b)
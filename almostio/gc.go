@@ -0,0 +1,211 @@
+package almostio
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// GCOptions configures the garbage collection.
+type GCOptions struct {
+	// DryRun only reports the garbage without removing it.
+	DryRun bool
+	// TempFileAge keeps the temp files modified more recently, they might belong to writes of
+	// other processes. Temp files of the writes still open in this overlay are always kept. Shared
+	// roots use sharedTempFileAge when it is zero.
+	TempFileAge time.Duration
+}
+
+// sharedTempFileAge keeps the temp files of shared roots when GCOptions.TempFileAge is not set,
+// the writes of other processes cannot be told from the aborted ones.
+const sharedTempFileAge = 24 * time.Hour
+
+// GCReport lists the garbage found, all the lists are sorted.
+type GCReport struct {
+	// Untracked are the local files not referenced by any entry.
+	Untracked []string
+	// TempFiles are the local paths of the temp files left by the aborted writes.
+	TempFiles []string
+	// Missing are the names of the entries which local files do not exist.
+	Missing []string
+	// Bytes is the total size of the untracked and temp files.
+	Bytes int64
+}
+
+// collectable is an overlay with local files that could become garbage.
+type collectable interface {
+	collectGarbage(options GCOptions) (*GCReport, error)
+}
+
+// GC removes the local files not referenced by the metadata, the temp files of the aborted writes
+// and the entries which local files disappeared. Overlays without local files have nothing to
+// collect and get an empty report.
+func GC(o Overlay, options GCOptions) (*GCReport, error) {
+	if co, ok := o.(collectable); ok {
+		return co.collectGarbage(options)
+	}
+	return &GCReport{Untracked: []string{}, TempFiles: []string{}, Missing: []string{}}, nil
+}
+
+// StartGC runs GC with the given interval in the background until the returned function is
+// called. The results of every run are passed to onReport if it is not nil.
+func StartGC(o Overlay, interval time.Duration, options GCOptions, onReport func(*GCReport, error)) func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				report, err := GC(o, options)
+				if onReport != nil {
+					onReport(report, err)
+				}
+			}
+		}
+	}()
+
+	once := sync.Once{}
+	return func() {
+		once.Do(func() {
+			close(stop)
+			<-done
+		})
+	}
+}
+
+// trackedWriter calls onClose after the write is closed, successfully or not, or aborted.
+type trackedWriter struct {
+	io.WriteCloser
+
+	onClose func()
+	// onAbort discards the write instead of closing it.
+	onAbort func()
+}
+
+func (tw *trackedWriter) Close() error {
+	defer tw.onClose()
+	return tw.WriteCloser.Close()
+}
+
+func (tw *trackedWriter) abort() {
+	defer tw.onClose()
+	tw.onAbort()
+}
+
+// createTemp creates a temp file for a write and marks it as used until untrack is called.
+func (lo *localOverlay) createTemp() (*os.File, error) {
+	lo.lock.Lock()
+	defer lo.lock.Unlock()
+
+	if err := lo.checkWritable(); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(lo.resolve(systemFolderName, tempFolderName), "write-*")
+	if err != nil {
+		return nil, err
+	}
+	lo.writing[f.Name()] = true
+	return f, nil
+}
+
+func (lo *localOverlay) untrack(tempFile string) {
+	lo.lock.Lock()
+	defer lo.lock.Unlock()
+
+	delete(lo.writing, tempFile)
+}
+
+// findGarbage looks for the garbage without blocking the writes, returns the entries with missing
+// files to check that they did not change before the removal.
+func (lo *localOverlay) findGarbage(options GCOptions) (*GCReport, map[string]*FileMetadata, error) {
+	untracked, err := lo.untrackedFiles()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lo.lock.RLock()
+	defer lo.lock.RUnlock()
+
+	report := &GCReport{Untracked: untracked, TempFiles: []string{}, Missing: []string{}}
+	for _, localName := range untracked {
+		if info, err := os.Stat(lo.resolve(localName)); err == nil {
+			report.Bytes += info.Size()
+		}
+	}
+
+	tempFileAge := options.TempFileAge
+	if lo.shared && tempFileAge == 0 {
+		tempFileAge = sharedTempFileAge
+	}
+	tempFolder := lo.resolve(systemFolderName, tempFolderName)
+	entries, err := os.ReadDir(tempFolder)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		path := filepath.Join(tempFolder, entry.Name())
+		if err != nil || lo.writing[path] || time.Since(info.ModTime()) < tempFileAge {
+			continue
+		}
+		report.TempFiles = append(report.TempFiles, filepath.ToSlash(filepath.Join(systemFolderName, tempFolderName, entry.Name())))
+		report.Bytes += info.Size()
+	}
+
+	missing := map[string]*FileMetadata{}
+	for name, md := range lo.metadata.FileMetadata {
+		if _, err := os.Stat(lo.resolve(md.LocalName)); os.IsNotExist(err) {
+			missing[name] = md
+			report.Missing = append(report.Missing, name)
+		}
+	}
+	sort.Strings(report.Missing)
+	return report, missing, nil
+}
+
+func (lo *localOverlay) collectGarbage(options GCOptions) (*GCReport, error) {
+	report, missing, err := lo.findGarbage(options)
+	if err != nil || options.DryRun {
+		return report, err
+	}
+	if err := lo.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	lo.lock.Lock()
+	defer lo.lock.Unlock()
+
+	for _, tempFile := range report.TempFiles {
+		if path := lo.resolve(tempFile); !lo.writing[path] {
+			os.Remove(path)
+		}
+	}
+
+	// Entries are compared by pointer, so the files written since the scan are kept
+	removed := []*FileMetadata{}
+	for name, md := range missing {
+		if lo.metadata.FileMetadata[name] == md {
+			lo.setEntry(name, nil)
+			removed = append(removed, md)
+		}
+	}
+	if err := lo.writeMetadata(); err != nil {
+		for _, md := range removed {
+			lo.setEntry(md.Name, md)
+		}
+		return nil, err
+	}
+	for _, md := range removed {
+		lo.watchers.notify(Event{Type: EventDeleted, Metadata: md})
+	}
+	// Files referenced since the scan are skipped
+	return report, lo.removeUnused(report.Untracked)
+}
@@ -0,0 +1,121 @@
+package almostio
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// addGarbage leaves an untracked file, a temp file and an entry without the local file.
+func addGarbage(o *localOverlay) {
+	writeOverlayFile(o, "Kept", []byte("kept"))
+	writeOverlayFile(o, "Missing", []byte("missing"))
+	os.Remove(filepath.Join(o.root, o.GetMetadata([]string{"Missing"})[0].LocalName))
+	os.MkdirAll(filepath.Join(o.root, "nested"), defaultDirPermissions)
+	os.WriteFile(filepath.Join(o.root, "nested", "untracked"), []byte("untracked"), defaultPermissions)
+	os.WriteFile(filepath.Join(o.root, systemFolderName, tempFolderName, "write-aborted"), []byte("temp"), defaultPermissions)
+}
+
+func TestGC(t *testing.T) {
+	wantReport := &GCReport{
+		Untracked: []string{"nested/untracked"},
+		TempFiles: []string{".overlay/tmp/write-aborted"},
+		Missing:   []string{"Missing"},
+		Bytes:     int64(len("untracked") + len("temp")),
+	}
+
+	t.Run("Dry run only reports garbage", func(t *testing.T) {
+		o := newTestOverlay(t, "")
+		addGarbage(o)
+		root := o.root
+		before := allLocalFiles(t, root)
+
+		report, err := GC(o, GCOptions{DryRun: true})
+		if err != nil || !reflect.DeepEqual(report, wantReport) {
+			t.Errorf("Expected report %v, but got %v, %v", wantReport, report, err)
+		}
+		if after := allLocalFiles(t, root); !reflect.DeepEqual(before, after) {
+			t.Errorf("Expected no changes, but files changed from %v to %v", before, after)
+		}
+		if names := listNames(o); !reflect.DeepEqual(names, []string{"Kept", "Missing"}) {
+			t.Errorf("Expected no metadata changes, but got %v", names)
+		}
+	})
+
+	t.Run("Garbage is removed", func(t *testing.T) {
+		o := newTestOverlay(t, "")
+		addGarbage(o)
+		root := o.root
+		w := o.Watch("")
+		defer w.Close()
+		open := must(o.OpenWrite("Open"))
+		defer open.Close()
+
+		report, err := GC(o, GCOptions{})
+		if err != nil || !reflect.DeepEqual(report, wantReport) {
+			t.Errorf("Expected report %v, but got %v, %v", wantReport, report, err)
+		}
+		if names := listNames(o); !reflect.DeepEqual(names, []string{"Kept"}) {
+			t.Errorf("Expected missing entry to be removed, but got %v", names)
+		}
+		if events := pendingEvents(w); !reflect.DeepEqual(events, []string{"deleted Missing"}) {
+			t.Errorf("Expected delete event, but got %v", events)
+		}
+		if _, err := os.Stat(filepath.Join(root, "nested")); !os.IsNotExist(err) {
+			t.Errorf("Expected empty folder to be removed")
+		}
+		if entries, _ := os.ReadDir(filepath.Join(root, systemFolderName, tempFolderName)); len(entries) != 1 {
+			t.Errorf("Expected only the temp file of the open write, but got %v", entries)
+		}
+
+		open.Write([]byte("open"))
+		if err := open.Close(); err != nil {
+			t.Errorf("Cannot close the write: %v", err)
+		}
+		if got, err := readOverlayFile(o, "Open"); err != nil || string(got) != "open" {
+			t.Errorf("Expected open write to succeed, but got %q, %v", got, err)
+		}
+		if report := must(GC(o, GCOptions{})); len(report.TempFiles) != 0 {
+			t.Errorf("Expected temp file of the closed write to be gone, but got %v", report.TempFiles)
+		}
+	})
+
+	t.Run("Recent temp files are kept", func(t *testing.T) {
+		o := newTestOverlay(t, "")
+		addGarbage(o)
+		if report := must(GC(o, GCOptions{TempFileAge: time.Hour})); len(report.TempFiles) != 0 {
+			t.Errorf("Expected recent temp files to be kept, but got %v", report.TempFiles)
+		}
+	})
+
+	t.Run("Memory overlay has no garbage", func(t *testing.T) {
+		report, err := GC(NewMemoryOverlay(), GCOptions{})
+		if err != nil || len(report.Untracked)+len(report.TempFiles)+len(report.Missing) != 0 {
+			t.Errorf("Expected empty report, but got %v, %v", report, err)
+		}
+	})
+
+	t.Run("Background collection", func(t *testing.T) {
+		o := newTestOverlay(t, "")
+		addGarbage(o)
+		root := o.root
+		reports := make(chan *GCReport, 10)
+		stop := StartGC(o, time.Millisecond, GCOptions{}, func(report *GCReport, err error) {
+			reports <- report
+		})
+		select {
+		case <-reports:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected garbage collection to run")
+		}
+		stop()
+		stop()
+
+		kept := o.GetMetadata([]string{"Kept"})[0].LocalName
+		if files := allLocalFiles(t, root); !reflect.DeepEqual(files, []string{kept}) {
+			t.Errorf("Expected untracked file to be removed, but got %v", files)
+		}
+	})
+}
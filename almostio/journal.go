@@ -0,0 +1,123 @@
+package almostio
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const (
+	journalFolderName = "journal"
+	journalSuffix     = ".json"
+	// The overwritten local file is kept under the journal name with this suffix
+	journalBackupSuffix = ".old"
+)
+
+// journalMove is a local file moved aside by a change. Until the metadata of the change is saved,
+// the metadata still expects the content with the sha256 and codec under the local name.
+type journalMove struct {
+	LocalName string `json:"localName"`
+	Backup    string `json:"backup"`
+	Sha256    string `json:"sha256"`
+	Codec     string `json:"codec,omitempty"`
+}
+
+// journal records the moves of a single change before they are made, so a crash before the
+// metadata is saved could be rolled back on start.
+type journal struct {
+	path string
+	// backup is a local name for the overwritten file that is removed with the journal.
+	backup string
+}
+
+// newJournal reserves the journal for a change, the lock must be held by the caller.
+func (lo *localOverlay) newJournal() (*journal, error) {
+	dir := lo.resolve(systemFolderName, journalFolderName)
+	if err := os.MkdirAll(dir, defaultDirPermissions); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(dir, "change-*"+journalSuffix)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	return lo.openJournal(f.Name()), nil
+}
+
+func (lo *localOverlay) openJournal(journalPath string) *journal {
+	name := strings.TrimSuffix(filepath.Base(journalPath), journalSuffix)
+	return &journal{
+		path:   journalPath,
+		backup: path.Join(systemFolderName, journalFolderName, name+journalBackupSuffix),
+	}
+}
+
+// record saves the moves, they must be made only after it succeeds.
+func (j *journal) record(moves ...journalMove) error {
+	data, err := json.Marshal(moves)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_TRUNC, defaultPermissions)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := (&syncedFile{f}).Close(); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(j.path))
+}
+
+// close removes the journal with its backup, the change is either saved or rolled back.
+func (j *journal) close(lo *localOverlay) {
+	os.Remove(lo.resolve(j.backup))
+	os.Remove(j.path)
+}
+
+// recoverJournals finishes the changes interrupted by a crash. If the metadata still expects the
+// content moved aside, the moves are undone in the reverse order, otherwise the change was saved
+// and only the backups are removed. The lock must be held by the caller.
+func (lo *localOverlay) recoverJournals() error {
+	dir := lo.resolve(systemFolderName, journalFolderName)
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	expected := map[string]*FileMetadata{}
+	for _, md := range lo.metadata.FileMetadata {
+		for _, version := range append(slices.Clone(md.Versions), md) {
+			expected[version.LocalName] = version
+		}
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), journalSuffix) {
+			continue
+		}
+		j := lo.openJournal(filepath.Join(dir, entry.Name()))
+		moves := []journalMove{}
+		// A journal without the complete record was left before any moves
+		if data, err := os.ReadFile(j.path); err == nil && json.Unmarshal(data, &moves) == nil {
+			for i := len(moves) - 1; i >= 0; i-- {
+				md, ok := expected[moves[i].LocalName]
+				if !ok || md.Sha256 != moves[i].Sha256 || md.Codec != moves[i].Codec {
+					continue
+				}
+				if err := lo.moveLocal(lo.resolve(moves[i].Backup), moves[i].LocalName); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+		}
+		j.close(lo)
+	}
+	return nil
+}
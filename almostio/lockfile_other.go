@@ -0,0 +1,17 @@
+//go:build !unix
+
+package almostio
+
+import (
+	"errors"
+	"os"
+)
+
+// lockFile is not supported, so the changes to the shared roots fail.
+func lockFile(f *os.File, exclusive bool) error {
+	return errors.ErrUnsupported
+}
+
+func unlockFile(f *os.File) error {
+	return errors.ErrUnsupported
+}
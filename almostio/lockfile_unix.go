@@ -0,0 +1,25 @@
+//go:build unix
+
+package almostio
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes the advisory lock, waiting for other processes to release it.
+func lockFile(f *os.File, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	for {
+		if err := syscall.Flock(int(f.Fd()), how); err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
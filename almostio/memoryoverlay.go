@@ -0,0 +1,227 @@
+package almostio
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryOverlay keeps all files in memory, useful for tests and short living caches.
+type MemoryOverlay struct {
+	Overlay
+
+	lock sync.RWMutex
+
+	files    map[string][]byte
+	metadata map[string]*FileMetadata
+	watchers watchers
+	detector ContentTypeDetector
+}
+
+func (mo *MemoryOverlay) OpenRead(name string) (io.ReadCloser, error) {
+	return mo.OpenSeekable(name)
+}
+
+func (mo *MemoryOverlay) OpenSeekable(name string) (SeekableReader, error) {
+	mo.lock.Lock()
+	defer mo.lock.Unlock()
+
+	data, ok := mo.files[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	accessed := *mo.metadata[name]
+	accessed.Accessed = time.Now()
+	mo.metadata[name] = &accessed
+	return &memoryReader{bytes.NewReader(data)}, nil
+}
+
+type memoryReader struct {
+	*bytes.Reader
+}
+
+func (mr *memoryReader) Close() error {
+	return nil
+}
+
+// OpenWrite buffers written data, the file becomes visible only after Close.
+func (mo *MemoryOverlay) OpenWrite(name string, options ...WriteOption) (io.WriteCloser, error) {
+	return mo.openWrite(name, newWriteOptions(options)), nil
+}
+
+func (mo *MemoryOverlay) openWrite(name string, wo *writeOptions) io.WriteCloser {
+	buffer := bytes.NewBuffer([]byte{})
+	return newContentWriter(NopWriteCloser(buffer), time.Now, wo.detectWith(mo.detector, name), func(fmd *FileMetadata) error {
+		mo.lock.Lock()
+		defer mo.lock.Unlock()
+
+		fmd.Name = name
+		old := mo.metadata[name]
+		inheritMetadata(fmd, old, wo)
+		mo.files[name] = buffer.Bytes()
+		mo.metadata[name] = fmd
+		mo.watchers.notify(changeEvent(old, fmd))
+		return nil
+	})
+}
+
+func (mo *MemoryOverlay) OpenAppend(name string, options ...WriteOption) (io.WriteCloser, error) {
+	wo := newWriteOptions(options)
+	wo.incomplete = true
+	wo.mergeAttributes = true
+	w := mo.openWrite(name, wo)
+
+	mo.lock.RLock()
+	existing := mo.files[name]
+	mo.lock.RUnlock()
+	if _, err := w.Write(existing); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (mo *MemoryOverlay) Finalize(name string) error {
+	mo.lock.Lock()
+	defer mo.lock.Unlock()
+
+	md, ok := mo.metadata[name]
+	if !ok {
+		return os.ErrNotExist
+	}
+	finalized := *md
+	finalized.Incomplete = false
+	mo.metadata[name] = &finalized
+	mo.watchers.notify(Event{Type: EventUpdated, Metadata: &finalized})
+	return nil
+}
+
+func (mo *MemoryOverlay) GetMetadata(names []string) []*FileMetadata {
+	mo.lock.RLock()
+	defer mo.lock.RUnlock()
+
+	result := make([]*FileMetadata, len(names))
+	for i, name := range names {
+		result[i] = mo.metadata[name]
+	}
+	return result
+}
+
+func (mo *MemoryOverlay) Delete(name string) error {
+	mo.lock.Lock()
+	defer mo.lock.Unlock()
+
+	md, ok := mo.metadata[name]
+	if !ok {
+		return os.ErrNotExist
+	}
+	delete(mo.files, name)
+	delete(mo.metadata, name)
+	mo.watchers.notify(Event{Type: EventDeleted, Metadata: md})
+	return nil
+}
+
+func (mo *MemoryOverlay) Rename(oldName string, newName string) error {
+	mo.lock.Lock()
+	defer mo.lock.Unlock()
+
+	data, ok := mo.files[oldName]
+	if !ok {
+		return os.ErrNotExist
+	}
+	if oldName == newName {
+		return nil
+	}
+	md := mo.metadata[oldName]
+	replaced := mo.metadata[newName]
+	renamed := *md
+	renamed.Name = newName
+
+	delete(mo.files, oldName)
+	delete(mo.metadata, oldName)
+	mo.files[newName] = data
+	mo.metadata[newName] = &renamed
+	mo.watchers.notify(Event{Type: EventDeleted, Metadata: md}, changeEvent(replaced, &renamed))
+	return nil
+}
+
+func (mo *MemoryOverlay) SetAttributes(name string, attributes map[string]string) error {
+	mo.lock.Lock()
+	defer mo.lock.Unlock()
+
+	md, ok := mo.metadata[name]
+	if !ok {
+		return os.ErrNotExist
+	}
+	updated := *md
+	updated.Attributes = mergeAttributes(md.Attributes, attributes)
+	mo.metadata[name] = &updated
+	mo.watchers.notify(Event{Type: EventUpdated, Metadata: &updated})
+	return nil
+}
+
+func (mo *MemoryOverlay) Watch(prefix string) *Watcher {
+	return mo.watchers.watch(prefix)
+}
+
+func (mo *MemoryOverlay) List(prefix string) []*FileMetadata {
+	mo.lock.RLock()
+	defer mo.lock.RUnlock()
+
+	result := []*FileMetadata{}
+	for name, md := range mo.metadata {
+		if strings.HasPrefix(name, prefix) {
+			result = append(result, md)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// Snapshot returns a copy of all file contents by name.
+func (mo *MemoryOverlay) Snapshot() map[string][]byte {
+	mo.lock.RLock()
+	defer mo.lock.RUnlock()
+
+	result := make(map[string][]byte, len(mo.files))
+	for name, data := range mo.files {
+		result[name] = bytes.Clone(data)
+	}
+	return result
+}
+
+// Restore replaces the overlay content with the snapshot, recalculating the metadata. Watchers
+// get EventOverflow, so they list the files again.
+func (mo *MemoryOverlay) Restore(snapshot map[string][]byte) error {
+	restored := NewMemoryOverlay()
+	for name, data := range snapshot {
+		wc, _ := restored.OpenWrite(name)
+		if _, err := wc.Write(data); err != nil {
+			return err
+		}
+		if err := wc.Close(); err != nil {
+			return err
+		}
+	}
+
+	mo.lock.Lock()
+	defer mo.lock.Unlock()
+	mo.files = restored.files
+	mo.metadata = restored.metadata
+	mo.watchers.notify(Event{Type: EventOverflow})
+	return nil
+}
+
+// NewMemoryOverlay creates an empty overlay that keeps files in memory.
+func NewMemoryOverlay() *MemoryOverlay {
+	return &MemoryOverlay{
+		files:    map[string][]byte{},
+		metadata: map[string]*FileMetadata{},
+		detector: NewHTTPContentTypeDetector(),
+	}
+}
@@ -0,0 +1,100 @@
+package almostio
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestMemoryOverlay(t *testing.T) {
+
+	t.Run("Write and read", func(t *testing.T) {
+		o := NewMemoryOverlay()
+		writeOverlayFile(o, "File 1", []byte{1, 2, 3})
+
+		if data, err := readOverlayFile(o, "File 1"); err != nil || !reflect.DeepEqual(data, []byte{1, 2, 3}) {
+			t.Errorf("Expected to read written data, but got %v, %v", data, err)
+		}
+		want := &FileMetadata{
+			Name:   "File 1",
+			Sha256: "039058c6f2c0cb492c533b0a4d14ef77cc0f78abccced5287d84a1a2011cfb81",
+			Mime:   "application/octet-stream",
+			Size:   3,
+		}
+		if md := withoutTimestamps(o.GetMetadata([]string{"File 1"})[0]); !reflect.DeepEqual(md, want) {
+			t.Errorf("Expected metadata %v, but got %v", want, md)
+		}
+	})
+
+	t.Run("Unclosed file not visible", func(t *testing.T) {
+		o := NewMemoryOverlay()
+		wc, _ := o.OpenWrite("File 1")
+		wc.Write([]byte{1, 2, 3})
+
+		if _, err := o.OpenRead("File 1"); !os.IsNotExist(err) {
+			t.Errorf("Expected os.ErrNotExist, but got %v", err)
+		}
+	})
+
+	t.Run("Delete, rename and list", func(t *testing.T) {
+		o := NewMemoryOverlay()
+		for _, name := range []string{"a/1", "a/2", "b/1"} {
+			writeOverlayFile(o, name, []byte(name))
+		}
+		if err := o.Delete("a/1"); err != nil {
+			t.Errorf("Cannot delete file: %s", err)
+		}
+		if err := o.Rename("b/1", "a/3"); err != nil {
+			t.Errorf("Cannot rename file: %s", err)
+		}
+		names := []string{}
+		for _, md := range o.List("a/") {
+			names = append(names, md.Name)
+		}
+		if !reflect.DeepEqual(names, []string{"a/2", "a/3"}) {
+			t.Errorf("Expected files [a/2 a/3], but got %v", names)
+		}
+		if err := o.Delete("a/1"); !os.IsNotExist(err) {
+			t.Errorf("Expected os.ErrNotExist, but got %v", err)
+		}
+	})
+
+	t.Run("Attributes", func(t *testing.T) {
+		o := NewMemoryOverlay()
+		wc, _ := o.OpenWrite("File 1", WithAttributes(map[string]string{"etag": "1"}))
+		wc.Close()
+		o.SetAttributes("File 1", map[string]string{"source": "url"})
+
+		want := map[string]string{"etag": "1", "source": "url"}
+		if md := o.GetMetadata([]string{"File 1"})[0]; !reflect.DeepEqual(md.Attributes, want) {
+			t.Errorf("Expected attributes %v, but got %v", want, md.Attributes)
+		}
+
+		wc, _ = o.OpenWrite("File 1", WithAttributes(map[string]string{"etag": "2"}))
+		wc.Close()
+		want = map[string]string{"etag": "2"}
+		if md := o.GetMetadata([]string{"File 1"})[0]; !reflect.DeepEqual(md.Attributes, want) {
+			t.Errorf("Expected overwrite to replace attributes with %v, but got %v", want, md.Attributes)
+		}
+	})
+
+	t.Run("Snapshot and restore", func(t *testing.T) {
+		o := NewMemoryOverlay()
+		writeOverlayFile(o, "File 1", []byte{1, 2, 3})
+		snapshot := o.Snapshot()
+
+		writeOverlayFile(o, "File 1", []byte{4, 5, 6})
+		writeOverlayFile(o, "File 2", []byte{7})
+		if !reflect.DeepEqual(snapshot, map[string][]byte{"File 1": {1, 2, 3}}) {
+			t.Errorf("Expected snapshot to be independent from overlay, but got %v", snapshot)
+		}
+
+		o.Restore(snapshot)
+		if !reflect.DeepEqual(o.Snapshot(), snapshot) {
+			t.Errorf("Expected restored overlay to match snapshot, but got %v", o.Snapshot())
+		}
+		if md := o.GetMetadata([]string{"File 1"})[0]; md.Sha256 != "039058c6f2c0cb492c533b0a4d14ef77cc0f78abccced5287d84a1a2011cfb81" {
+			t.Errorf("Expected metadata to be restored, but got %v", md)
+		}
+	})
+}
@@ -0,0 +1,302 @@
+package almostio
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	metadataLogFileName = "metadata.log"
+	// The log is compacted when it has this many times more records than files
+	logCompactionFactor = 4
+	// Small logs are never compacted
+	logCompactionMinRecords = 1024
+)
+
+// ErrCorruptedLog is returned when a record in the middle of the metadata log cannot be read.
+var ErrCorruptedLog = errors.New("corrupted metadata log")
+
+// MetadataChange is a single file metadata update, nil Metadata means the file was removed.
+type MetadataChange struct {
+	Name     string        `json:"name"`
+	Metadata *FileMetadata `json:"metadata"`
+}
+
+// logRecord is a line of the metadata log, the log starts with a record that has only the schema
+// version.
+type logRecord struct {
+	MetadataChange
+
+	SchemaVersion int `json:"schemaVersion,omitempty"`
+}
+
+// MetadataStore persists the overlay metadata.
+type MetadataStore interface {
+	// Load reads the stored metadata, returns os.ErrNotExist if nothing was stored yet.
+	Load() (*OverlayMetadata, error)
+	// Save persists the changes. The complete metadata with the changes applied is passed as md,
+	// the store could save either md or the changes only. When the schema version of md changes,
+	// all the entries are passed as changes.
+	Save(md *OverlayMetadata, changes []MetadataChange) error
+}
+
+// WithMetadataStore configures where the overlay keeps the metadata. By default, the whole
+// metadata is written to ".overlay/metadata.json" with the overlay marshaller on every change.
+func WithMetadataStore(store MetadataStore) LocalOverlayOption {
+	return func(lo *localOverlay) {
+		lo.store = store
+	}
+}
+
+// WithLogMetadataStore keeps the metadata in the append-only log in the overlay system folder.
+// Metadata from the default store is used to start the log when there is no log yet. Roots that
+// already have the log use it without this option too, unless another store is configured.
+func WithLogMetadataStore() LocalOverlayOption {
+	return func(lo *localOverlay) {
+		lo.store = &logMetadataStore{
+			path:                 lo.resolve(systemFolderName, metadataLogFileName),
+			initial:              lo.store,
+			compactionMinRecords: logCompactionMinRecords,
+		}
+	}
+}
+
+// hasMetadataLog tells if the log exists, including the versions left by an interrupted compaction.
+func hasMetadataLog(path string) bool {
+	_, err := os.Stat(currentFileAtomic(path))
+	return err == nil
+}
+
+// snapshotMetadataStore rewrites the whole metadata on every change.
+type snapshotMetadataStore struct {
+	MetadataStore
+
+	path     string
+	marshal  *Marshaller[OverlayMetadata]
+	readOnly bool
+}
+
+// NewSnapshotMetadataStore creates a store that rewrites the whole metadata file atomically on
+// every change, keeping the previous version as a backup.
+func NewSnapshotMetadataStore(path string, marshaller *Marshaller[OverlayMetadata]) MetadataStore {
+	return &snapshotMetadataStore{
+		path:    path,
+		marshal: marshaller,
+	}
+}
+
+func (ss *snapshotMetadataStore) Load() (*OverlayMetadata, error) {
+	return readFileAtomic(ss.path, ss.marshal.Unmarshal, !ss.readOnly)
+}
+
+func (ss *snapshotMetadataStore) setReadOnly() {
+	ss.readOnly = true
+}
+
+func (ss *snapshotMetadataStore) Save(md *OverlayMetadata, changes []MetadataChange) error {
+	data, err := ss.marshal.Marshal(md)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(ss.path, data)
+}
+
+// logMetadataStore appends changes to the log file, one json record per line. The log is
+// rewritten with the current metadata when it grows too much or the schema version changes.
+type logMetadataStore struct {
+	MetadataStore
+
+	lock sync.Mutex
+
+	path          string
+	records       int
+	schemaVersion int
+	initial       MetadataStore
+	readOnly      bool
+	// A failed append could not be undone, the log is rewritten on the next save
+	broken bool
+
+	compactionMinRecords int
+}
+
+// NewLogMetadataStore creates a store that appends every change to the log file, so saving
+// takes the same time regardless of the number of files. The log is compacted when it has
+// several times more records than there are files.
+func NewLogMetadataStore(path string) MetadataStore {
+	return &logMetadataStore{
+		path:                 path,
+		compactionMinRecords: logCompactionMinRecords,
+	}
+}
+
+func (ls *logMetadataStore) Load() (*OverlayMetadata, error) {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+
+	path := ls.path
+	if ls.readOnly {
+		path = currentFileAtomic(ls.path)
+	} else if err := restoreFileAtomic(ls.path); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return ls.loadInitial()
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	md := &OverlayMetadata{
+		FileMetadata: map[string]*FileMetadata{},
+	}
+	ls.records = 0
+	ls.schemaVersion = 0
+	validSize := int64(0)
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			// Last line without the line break is a record torn by a crash
+			break
+		}
+		change := &logRecord{}
+		if err := json.Unmarshal(line, change); err != nil {
+			// Appends are undone on failure, so a complete broken line is not left by a crash
+			return nil, fmt.Errorf("%w: %s, line %d: %w", ErrCorruptedLog, path, ls.records+1, err)
+		}
+		if change.SchemaVersion != 0 {
+			md.SchemaVersion = change.SchemaVersion
+			ls.schemaVersion = change.SchemaVersion
+		} else if change.Metadata == nil {
+			delete(md.FileMetadata, change.Name)
+		} else {
+			md.FileMetadata[change.Name] = change.Metadata
+		}
+		ls.records++
+		validSize += int64(len(line))
+	}
+	if stat, err := f.Stat(); err == nil && stat.Size() != validSize && !ls.readOnly {
+		if err := os.Truncate(ls.path, validSize); err != nil {
+			return nil, err
+		}
+	}
+	return md, nil
+}
+
+func (ls *logMetadataStore) loadInitial() (*OverlayMetadata, error) {
+	if ls.initial == nil {
+		return nil, os.ErrNotExist
+	}
+	md, err := ls.initial.Load()
+	if err != nil {
+		return nil, err
+	}
+	if ls.readOnly {
+		return md, nil
+	}
+	if err := ls.compact(md); err != nil {
+		return nil, err
+	}
+	return md, nil
+}
+
+func (ls *logMetadataStore) setReadOnly() {
+	ls.readOnly = true
+	if initial, ok := ls.initial.(readOnlyStore); ok {
+		initial.setReadOnly()
+	}
+}
+
+func (ls *logMetadataStore) Save(md *OverlayMetadata, changes []MetadataChange) error {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+
+	if ls.broken || md.SchemaVersion != ls.schemaVersion ||
+		ls.records+len(changes) > max(ls.compactionMinRecords, logCompactionFactor*len(md.FileMetadata)) {
+		return ls.compact(md)
+	}
+
+	data := bytes.NewBuffer([]byte{})
+	if err := writeChanges(data, changes); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(ls.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, defaultPermissions)
+	if err != nil {
+		return err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if _, err = f.Write(data.Bytes()); err == nil {
+		err = (&syncedFile{f}).Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		ls.undoAppend(stat.Size())
+		return err
+	}
+	ls.records += len(changes)
+	return nil
+}
+
+// undoAppend cuts the partially written records, so the records appended later are not lost
+// after the broken line on the next load.
+func (ls *logMetadataStore) undoAppend(size int64) {
+	if err := os.Truncate(ls.path, size); err != nil {
+		ls.broken = true
+	}
+}
+
+// compact replaces the log with the schema version and a single record per file.
+func (ls *logMetadataStore) compact(md *OverlayMetadata) error {
+	names := []string{}
+	for name := range md.FileMetadata {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	changes := make([]MetadataChange, len(names))
+	for i, name := range names {
+		changes[i] = MetadataChange{Name: name, Metadata: md.FileMetadata[name]}
+	}
+
+	data := bytes.NewBuffer([]byte{})
+	if md.SchemaVersion != 0 {
+		if err := json.NewEncoder(data).Encode(map[string]int{"schemaVersion": md.SchemaVersion}); err != nil {
+			return err
+		}
+	}
+	if err := writeChanges(data, changes); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(ls.path), defaultDirPermissions); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(ls.path, data.Bytes()); err != nil {
+		return err
+	}
+	ls.records = len(changes)
+	ls.schemaVersion = md.SchemaVersion
+	ls.broken = false
+	return nil
+}
+
+func writeChanges(data *bytes.Buffer, changes []MetadataChange) error {
+	encoder := json.NewEncoder(data)
+	for _, change := range changes {
+		if err := encoder.Encode(change); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package almostio
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func countLines(t *testing.T, path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Cannot read %s: %s", path, err)
+	}
+	return bytes.Count(data, []byte{'\n'})
+}
+
+func TestLogMetadataStore(t *testing.T) {
+
+	newOverlay := func(t *testing.T, root string) Overlay {
+		return newTestOverlay(t, root, WithLogMetadataStore())
+	}
+
+	t.Run("Changes restored on start", func(t *testing.T) {
+		root := filepath.Join(t.TempDir(), "overlay_root")
+		o := newOverlay(t, root)
+		writeOverlayFile(o, "File 1", []byte("File 1"))
+		writeOverlayFile(o, "File 2", []byte("File 2"))
+		writeOverlayFile(o, "File 3", []byte("File 3"))
+		o.Delete("File 2")
+		o.Rename("File 3", "File 4")
+		o.SetAttributes("File 1", map[string]string{"etag": "1"})
+
+		reopened := newOverlay(t, root)
+		if names := listNames(reopened); !reflect.DeepEqual(names, []string{"File 1", "File 4"}) {
+			t.Errorf("Expected [File 1 File 4], but got %v", names)
+		}
+		if md := reopened.GetMetadata([]string{"File 1"})[0]; md.Attributes["etag"] != "1" {
+			t.Errorf("Expected attributes to be restored, but got %v", md)
+		}
+		if lines := countLines(t, filepath.Join(root, systemFolderName, metadataLogFileName)); lines != 8 {
+			t.Errorf("Expected schema version and one log record per change, but got %d", lines)
+		}
+	})
+
+	t.Run("Torn record dropped", func(t *testing.T) {
+		root := filepath.Join(t.TempDir(), "overlay_root")
+		o := newOverlay(t, root)
+		writeOverlayFile(o, "File 1", []byte("File 1"))
+
+		logFile := filepath.Join(root, systemFolderName, metadataLogFileName)
+		f, _ := os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND, defaultPermissions)
+		f.Write([]byte(`{"name": "File 2", "metad`))
+		f.Close()
+
+		reopened := newOverlay(t, root)
+		if names := listNames(reopened); !reflect.DeepEqual(names, []string{"File 1"}) {
+			t.Errorf("Expected only complete records, but got %v", names)
+		}
+		writeOverlayFile(reopened, "File 3", []byte("File 3"))
+		if names := listNames(newOverlay(t, root)); !reflect.DeepEqual(names, []string{"File 1", "File 3"}) {
+			t.Errorf("Expected records after the torn one to be readable, but got %v", names)
+		}
+	})
+
+	t.Run("Failed append is undone", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "metadata.log")
+		store := NewLogMetadataStore(path).(*logMetadataStore)
+		md := &OverlayMetadata{FileMetadata: map[string]*FileMetadata{}}
+		for _, name := range []string{"a", "b", "c"} {
+			if name == "b" {
+				// A write that stopped halfway through the record
+				stat := must(os.Stat(path))
+				f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, defaultPermissions)
+				f.Write([]byte(`{"name": "b", "metad`))
+				f.Close()
+				store.undoAppend(stat.Size())
+				continue
+			}
+			md.FileMetadata[name] = &FileMetadata{Name: name}
+			if err := store.Save(md, []MetadataChange{{Name: name, Metadata: md.FileMetadata[name]}}); err != nil {
+				t.Fatalf("Cannot save metadata: %s", err)
+			}
+		}
+
+		loaded, err := NewLogMetadataStore(path).Load()
+		if err != nil || !reflect.DeepEqual(loaded, md) {
+			t.Errorf("Expected records after the failed one to be kept %v, but got %v, %v", md, loaded, err)
+		}
+	})
+
+	t.Run("Broken record in the middle", func(t *testing.T) {
+		root := filepath.Join(t.TempDir(), "overlay_root")
+		o := newOverlay(t, root)
+		writeOverlayFile(o, "a", []byte("a"))
+
+		logFile := filepath.Join(root, systemFolderName, metadataLogFileName)
+		f, _ := os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND, defaultPermissions)
+		f.Write([]byte(`{"name": "b", "metad`))
+		f.Close()
+		writeOverlayFile(o, "c", []byte("c"))
+		before := must(os.ReadFile(logFile))
+
+		if _, err := NewLocalOverlay(root, NewJsonMarshal[OverlayMetadata](), WithLogMetadataStore()); !errors.Is(err, ErrCorruptedLog) {
+			t.Errorf("Expected corrupted log error, but got %v", err)
+		}
+		if after := must(os.ReadFile(logFile)); !bytes.Equal(before, after) {
+			t.Errorf("Expected corrupted log to be kept, but got %q", after)
+		}
+	})
+
+	t.Run("Log compaction", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "metadata.log")
+		store := NewLogMetadataStore(path)
+		store.(*logMetadataStore).compactionMinRecords = 10
+
+		md := &OverlayMetadata{FileMetadata: map[string]*FileMetadata{}}
+		for i := range 100 {
+			fmd := &FileMetadata{Name: fmt.Sprintf("File %d", i%3)}
+			md.FileMetadata[fmd.Name] = fmd
+			if err := store.Save(md, []MetadataChange{{Name: fmd.Name, Metadata: fmd}}); err != nil {
+				t.Fatalf("Cannot save metadata: %s", err)
+			}
+		}
+		if lines := countLines(t, path); lines > 10 {
+			t.Errorf("Expected log to be compacted, but got %d records", lines)
+		}
+		loaded, err := NewLogMetadataStore(path).Load()
+		if err != nil || !reflect.DeepEqual(loaded, md) {
+			t.Errorf("Expected compacted log to keep metadata %v, but got %v, %v", md, loaded, err)
+		}
+	})
+
+	t.Run("Log used without the option", func(t *testing.T) {
+		root := filepath.Join(t.TempDir(), "overlay_root")
+		writeOverlayFile(newOverlay(t, root), "File 1", []byte("File 1"))
+
+		o := newTestOverlay(t, root)
+		writeOverlayFile(o, "File 2", []byte("File 2"))
+		if report, err := Verify(o, VerifyOptions{}); err != nil || !report.IsClean() {
+			t.Errorf("Expected files from the log to be found, but got %v, %v", report, err)
+		}
+		if names := listNames(newOverlay(t, root)); !reflect.DeepEqual(names, []string{"File 1", "File 2"}) {
+			t.Errorf("Expected changes to be saved in the log, but got %v", names)
+		}
+	})
+
+	t.Run("Start from snapshot", func(t *testing.T) {
+		root := filepath.Join(t.TempDir(), "overlay_root")
+		o, _ := NewLocalOverlay(root, NewJsonMarshal[OverlayMetadata]())
+		writeOverlayFile(o, "File 1", []byte("File 1"))
+
+		reopened := newOverlay(t, root)
+		if data, err := readOverlayFile(reopened, "File 1"); err != nil || string(data) != "File 1" {
+			t.Errorf("Expected files from snapshot to be available, but got %q, %v", data, err)
+		}
+	})
+}
@@ -32,7 +32,7 @@ func (nop *nopWriteCloser) Write(p []byte) (int, error) {
 type MultiWriteCloser struct {
 	io.WriteCloser
 
-	onClose func()
+	onClose func() error
 	writers []io.WriteCloser
 }
 
@@ -58,11 +58,21 @@ func (mw *MultiWriteCloser) AddWriteCloser(w io.WriteCloser) *MultiWriteCloser {
 
 // SetOnClose configures a function that is called after all child WriteClosers successfuly closed.
 func (mw *MultiWriteCloser) SetOnClose(onClose func()) *MultiWriteCloser {
+	return mw.SetOnCloseError(func() error {
+		onClose()
+		return nil
+	})
+}
+
+// SetOnCloseError works like SetOnClose, but the error returned by the function is returned
+// from Close.
+func (mw *MultiWriteCloser) SetOnCloseError(onClose func() error) *MultiWriteCloser {
 	mw.onClose = onClose
 	return mw
 }
 
-// Close invokes "Close" for all underlying WriteClosers, returns an error if any of them fails.
+// Close invokes "Close" for all underlying WriteClosers, returns an error if any of them or the
+// onClose function fails.
 func (mw *MultiWriteCloser) Close() error {
 	for _, wc := range mw.writers {
 		if err := wc.Close(); err != nil {
@@ -70,7 +80,7 @@ func (mw *MultiWriteCloser) Close() error {
 		}
 	}
 	if mw.onClose != nil {
-		mw.onClose()
+		return mw.onClose()
 	}
 	return nil
 }
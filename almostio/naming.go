@@ -0,0 +1,232 @@
+package almostio
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// NamingStrategy chooses the local file names for the local overlay.
+type NamingStrategy interface {
+	// LocalName returns a relative slash separated path for the file. Taken checks if the local
+	// name is already used by another file or conflicts with existing folders.
+	LocalName(name string, taken func(localName string) bool) string
+}
+
+// WithNaming sets the strategy for the local file names, ignored for content-addressed overlays.
+// Use MigrateLocalOverlay to rename the files of an existing overlay.
+func WithNaming(naming NamingStrategy) LocalOverlayOption {
+	return func(lo *localOverlay) {
+		lo.naming = naming
+	}
+}
+
+// keepTail cuts the beginning of the string to fit into maxBytes, keeping whole runes.
+func keepTail(s string, maxBytes int) string {
+	if len(s) <= maxBytes {
+		return s
+	}
+	s = s[len(s)-maxBytes:]
+	for len(s) > 0 && !utf8.RuneStart(s[0]) {
+		s = s[1:]
+	}
+	return s
+}
+
+func fnvHash(name string) string {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return fmt.Sprintf("%x", h.Sum([]byte{}))
+}
+
+func sanitizeASCII(name string) string {
+	return nonAlphanumericRegex.ReplaceAllString(name, "_")
+}
+
+type hashedNaming struct {
+	NamingStrategy
+
+	sanitize       func(string) string
+	checkCollision bool
+}
+
+// NewHashedNaming names the files with the fnv32 hash of the name followed by the end of the
+// name with only latin letters, digits and dots kept, e.g. "ea3c4293_http_someurl.domain_".
+// This is the default strategy.
+func NewHashedNaming() NamingStrategy {
+	return &hashedNaming{
+		sanitize: sanitizeASCII,
+	}
+}
+
+// NewCollisionCheckedNaming works like NewHashedNaming, but uses the sha256 of the name when the
+// fnv32 one is already taken by another file.
+func NewCollisionCheckedNaming() NamingStrategy {
+	return &hashedNaming{
+		sanitize:       sanitizeASCII,
+		checkCollision: true,
+	}
+}
+
+// NewTransliteratingNaming works like NewCollisionCheckedNaming, but replaces cyrillic, greek
+// and accented latin letters with their latin transliterations and keeps other letters as is,
+// e.g. "Привет, мир" becomes "bc930f96_Privet_mir".
+func NewTransliteratingNaming() NamingStrategy {
+	return &hashedNaming{
+		sanitize:       transliterate,
+		checkCollision: true,
+	}
+}
+
+func (hn *hashedNaming) LocalName(name string, taken func(string) bool) string {
+	sanitized := hn.sanitize(name)
+	hash := fnvHash(name)
+	localName := hash + "_" + keepTail(sanitized, maxNameLength-len(hash))
+	if !hn.checkCollision || !taken(localName) {
+		return localName
+	}
+
+	hash = fmt.Sprintf("%x", sha256.Sum256([]byte(name)))
+	base := hash + "_" + keepTail(sanitized, maxNameLength-len(hash))
+	localName = base
+	for i := 1; taken(localName); i++ {
+		localName = fmt.Sprintf("%s_%d", base, i)
+	}
+	return localName
+}
+
+type urlPathNaming struct {
+	NamingStrategy
+
+	fallback NamingStrategy
+}
+
+// NewURLPathNaming maps urls to nested folders by host and path, e.g.
+// "https://example.com/docs/page.html?lang=en" becomes "example.com/docs/page.html_lang_en",
+// and paths ending with a slash get "index" as the file name. Names that are not urls or map to
+// taken local names, e.g. "http://a/b" when "http://a/b/c" is a folder, use
+// NewCollisionCheckedNaming.
+func NewURLPathNaming() NamingStrategy {
+	return &urlPathNaming{
+		fallback: NewCollisionCheckedNaming(),
+	}
+}
+
+func (un *urlPathNaming) LocalName(name string, taken func(string) bool) string {
+	u, err := url.Parse(name)
+	if err != nil || u.Host == "" {
+		return un.fallback.LocalName(name, taken)
+	}
+
+	segments := appendSegments([]string{}, u.Host)
+	hostSegments := len(segments)
+	segments = appendSegments(segments, strings.Split(u.Path, "/")...)
+	if len(segments) == hostSegments || strings.HasSuffix(u.Path, "/") {
+		segments = append(segments, "index")
+	}
+	if u.RawQuery != "" {
+		segments[len(segments)-1] += "_" + u.RawQuery
+	}
+	for i, segment := range segments {
+		segments[i] = keepTail(transliterate(segment), maxNameLength)
+	}
+
+	localName := path.Join(segments...)
+	if !isLocalName(localName) || taken(localName) {
+		return un.fallback.LocalName(name, taken)
+	}
+	return localName
+}
+
+// appendSegments adds the parts that are safe to use as folder or file names.
+func appendSegments(segments []string, parts ...string) []string {
+	for _, part := range parts {
+		if part != "" && part != "." && part != ".." {
+			segments = append(segments, part)
+		}
+	}
+	return segments
+}
+
+// isLocalName checks that the slash separated local name stays inside the overlay root.
+func isLocalName(localName string) bool {
+	return filepath.IsLocal(filepath.FromSlash(localName))
+}
+
+var transliterations = map[rune]string{}
+
+func addTransliterations(letters string, latin ...string) {
+	for i, letter := range []rune(letters) {
+		transliterations[letter] = latin[i]
+	}
+}
+
+func addLatinTransliterations(letters string, latin string) {
+	for _, letter := range letters {
+		transliterations[letter] = latin
+	}
+}
+
+func init() {
+	addTransliterations("абвгдеёжзийклмнопрстуфхцчшщъыьэюяіїєґў",
+		"a", "b", "v", "g", "d", "e", "e", "zh", "z", "i", "y", "k", "l", "m", "n", "o", "p", "r",
+		"s", "t", "u", "f", "kh", "ts", "ch", "sh", "shch", "", "y", "", "e", "yu", "ya", "i", "yi",
+		"ye", "g", "u")
+	addTransliterations("αβγδεζηθικλμνξοπρσςτυφχψωάέήίόύώϊϋΐΰ",
+		"a", "v", "g", "d", "e", "z", "i", "th", "i", "k", "l", "m", "n", "x", "o", "p", "r", "s",
+		"s", "t", "y", "f", "ch", "ps", "o", "a", "e", "i", "i", "o", "y", "o", "i", "y", "i", "y")
+	addLatinTransliterations("àáâãäåāăą", "a")
+	addLatinTransliterations("çćĉċč", "c")
+	addLatinTransliterations("ďđð", "d")
+	addLatinTransliterations("èéêëēĕėęě", "e")
+	addLatinTransliterations("ĝğġģ", "g")
+	addLatinTransliterations("ĥħ", "h")
+	addLatinTransliterations("ìíîïĩīĭįı", "i")
+	addLatinTransliterations("ĵ", "j")
+	addLatinTransliterations("ķ", "k")
+	addLatinTransliterations("ĺļľŀł", "l")
+	addLatinTransliterations("ñńņňŉ", "n")
+	addLatinTransliterations("òóôõöøōŏő", "o")
+	addLatinTransliterations("ŕŗř", "r")
+	addLatinTransliterations("śŝşšș", "s")
+	addLatinTransliterations("ţťŧț", "t")
+	addLatinTransliterations("ùúûüũūŭůűų", "u")
+	addLatinTransliterations("ŵ", "w")
+	addLatinTransliterations("ýÿŷ", "y")
+	addLatinTransliterations("źżž", "z")
+	addTransliterations("ßæœþ", "ss", "ae", "oe", "th")
+}
+
+// transliterate replaces the letters with known latin transliterations, keeps other letters and
+// digits, and replaces the rest with underscores.
+func transliterate(name string) string {
+	result := strings.Builder{}
+	underscore := false
+	for _, r := range name {
+		latin, known := transliterations[unicode.ToLower(r)]
+		switch {
+		case r < utf8.RuneSelf && (r == '.' || r == '-' || unicode.IsLetter(r) || unicode.IsDigit(r)):
+			latin = string(r)
+		case known && unicode.IsUpper(r) && latin != "":
+			latin = strings.ToUpper(latin[:1]) + latin[1:]
+		case known:
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			latin = string(r)
+		default:
+			if !underscore {
+				result.WriteRune('_')
+			}
+			underscore = true
+			continue
+		}
+		underscore = false
+		result.WriteString(latin)
+	}
+	return result.String()
+}
@@ -0,0 +1,197 @@
+package almostio
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// escapingNaming is a broken strategy that points outside the root.
+type escapingNaming struct {
+	NamingStrategy
+}
+
+func (escapingNaming) LocalName(name string, taken func(string) bool) string {
+	return "../" + fnvHash(name)
+}
+
+func TestNamingStrategies(t *testing.T) {
+	notTaken := func(string) bool { return false }
+	// Fnv32 of "costarring" and "liquid" collide, so do the names with the same suffix
+	suffix := strings.Repeat("x", maxNameLength)
+	collidingA := "costarring" + suffix
+	collidingB := "liquid" + suffix
+
+	for _, tc := range []struct {
+		name   string
+		naming NamingStrategy
+		file   string
+		want   string
+	}{
+		{
+			name:   "hashed",
+			naming: NewHashedNaming(),
+			file:   "http://someurl.domain/",
+			want:   "ea3c4293_http_someurl.domain_",
+		},
+		{
+			name:   "hashed unicode",
+			naming: NewHashedNaming(),
+			file:   "Привет, мир",
+			want:   "bc930f96__",
+		},
+		{
+			name:   "transliterating",
+			naming: NewTransliteratingNaming(),
+			file:   "Привет, мир",
+			want:   "bc930f96_Privet_mir",
+		},
+		{
+			name:   "transliterating keeps unknown letters",
+			naming: NewTransliteratingNaming(),
+			file:   "Straße Ærø Ελλάδα 日本語",
+			want:   fnvHash("Straße Ærø Ελλάδα 日本語") + "_Strasse_Aero_Ellada_日本語",
+		},
+		{
+			name:   "url path",
+			naming: NewURLPathNaming(),
+			file:   "https://example.com/docs/page.html?lang=en",
+			want:   "example.com/docs/page.html_lang_en",
+		},
+		{
+			name:   "url path index",
+			naming: NewURLPathNaming(),
+			file:   "https://example.com/docs/",
+			want:   "example.com/docs/index",
+		},
+		{
+			name:   "url path parent references",
+			naming: NewURLPathNaming(),
+			file:   "https://example.com/../../etc/passwd",
+			want:   "example.com/etc/passwd",
+		},
+		{
+			name:   "url path host references",
+			naming: NewURLPathNaming(),
+			file:   "http://../escaped",
+			want:   "escaped",
+		},
+		{
+			name:   "url path not url",
+			naming: NewURLPathNaming(),
+			file:   "File 1",
+			want:   "644fe258_File_1",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.naming.LocalName(tc.file, notTaken); got != tc.want {
+				t.Errorf("Expected local name %q, but got %q", tc.want, got)
+			}
+		})
+	}
+
+	t.Run("Long unicode names are cut at rune boundary", func(t *testing.T) {
+		got := NewTransliteratingNaming().LocalName(strings.Repeat("日", maxNameLength), notTaken)
+		if len(got) > maxNameLength+1 || !strings.HasSuffix(got, "日") || strings.ContainsRune(got, '�') {
+			t.Errorf("Expected valid truncated name, but got %q", got)
+		}
+	})
+
+	t.Run("Collision checked naming uses longer hash", func(t *testing.T) {
+		naming := NewCollisionCheckedNaming()
+		first := naming.LocalName(collidingA, notTaken)
+		taken := func(localName string) bool { return localName == first }
+		if second := naming.LocalName(collidingB, taken); len(strings.Split(second, "_")[0]) != 64 {
+			t.Errorf("Expected sha256 based local name, but got %q", second)
+		}
+	})
+
+	t.Run("Colliding names in overlay", func(t *testing.T) {
+		for _, naming := range []NamingStrategy{NewCollisionCheckedNaming(), NewTransliteratingNaming()} {
+			o := newTestOverlay(t, "", WithNaming(naming))
+			writeOverlayFile(o, collidingA, []byte("A"))
+			writeOverlayFile(o, collidingB, []byte("B"))
+			writeOverlayFile(o, collidingB, []byte("B2"))
+
+			if got := must(readOverlayFile(o, collidingA)); string(got) != "A" {
+				t.Errorf("Expected first file to be kept, but got %q", got)
+			}
+			if got := must(readOverlayFile(o, collidingB)); string(got) != "B2" {
+				t.Errorf("Expected second file to be written, but got %q", got)
+			}
+			md := o.GetMetadata([]string{collidingA, collidingB})
+			if md[0].LocalName == md[1].LocalName {
+				t.Errorf("Expected different local names, but got %s", md[0].LocalName)
+			}
+		}
+	})
+
+	t.Run("Url path naming in overlay", func(t *testing.T) {
+		root := filepath.Join(t.TempDir(), "overlay_root")
+		o := newTestOverlay(t, root, WithNaming(NewURLPathNaming()))
+		files := map[string]string{
+			"http://example.com/a":   "a",
+			"http://example.com/a/b": "b",
+			"https://example.com/a":  "https a",
+			"http://example.com/":    "index",
+		}
+		for name, content := range files {
+			writeOverlayFile(o, name, []byte(content))
+		}
+		for name, content := range files {
+			if got, err := readOverlayFile(o, name); err != nil || string(got) != content {
+				t.Errorf("Expected %s to be %q, but got %q, %v", name, content, got, err)
+			}
+		}
+		if md := o.GetMetadata([]string{"http://example.com/"})[0]; md.LocalName != "example.com/index" {
+			t.Errorf("Expected readable local name, but got %s", md.LocalName)
+		}
+
+		for name := range files {
+			o.Delete(name)
+		}
+		if files := allLocalFiles(t, root); len(files) != 0 {
+			t.Errorf("Expected empty folders to be removed, but got %v", files)
+		}
+	})
+
+	t.Run("Local files stay inside the root", func(t *testing.T) {
+		parent := t.TempDir()
+		root := filepath.Join(parent, "overlay_root")
+		names := []string{"http://../escaped", "http://../../escaped/", "http://./../x", "http://..:80/escaped"}
+		for _, naming := range []NamingStrategy{NewURLPathNaming(), escapingNaming{}} {
+			o := newTestOverlay(t, root, WithNaming(naming))
+			for _, name := range names {
+				if err := writeOverlayFile(o, name, []byte(name)); err != nil {
+					t.Errorf("Cannot write %s: %v", name, err)
+				}
+				if got, err := readOverlayFile(o, name); err != nil || string(got) != name {
+					t.Errorf("Expected %s to be readable, but got %q, %v", name, got, err)
+				}
+			}
+			if entries := must(os.ReadDir(parent)); len(entries) != 1 {
+				t.Errorf("Expected files only in the overlay root, but got %v", entries)
+			}
+		}
+	})
+
+	t.Run("Migration to another naming", func(t *testing.T) {
+		root := filepath.Join(t.TempDir(), "overlay_root")
+		o := newTestOverlay(t, root, WithNaming(NewHashedNaming()))
+		writeOverlayFile(o, "http://example.com/a/b", []byte("b"))
+		writeOverlayFile(o, "File 1", []byte("1"))
+
+		if err := MigrateLocalOverlay(root, NewJsonMarshal[OverlayMetadata](), WithNaming(NewURLPathNaming())); err != nil {
+			t.Fatalf("Cannot migrate: %v", err)
+		}
+		o = newTestOverlay(t, root, WithNaming(NewURLPathNaming()))
+		if files := allLocalFiles(t, root); !reflect.DeepEqual(files, []string{"644fe258_File_1", "example.com/a/b"}) {
+			t.Errorf("Expected files to be renamed, but got %v", files)
+		}
+		if got := must(readOverlayFile(o, "http://example.com/a/b")); string(got) != "b" {
+			t.Errorf("Expected migrated file content, but got %q", got)
+		}
+	})
+}
@@ -4,13 +4,16 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"fmt"
-	"hash/fnv"
 	"io"
-	"net/http"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
 var (
@@ -24,6 +27,7 @@ const (
 	defaultPermissions    = 0644
 	systemFolderName      = ".overlay"
 	metadataFileName      = "metadata.json"
+	tempFolderName        = "tmp"
 )
 
 type FileMetadata struct {
@@ -31,146 +35,960 @@ type FileMetadata struct {
 	LocalName string `json:"localName"`
 	Sha256    string `json:"sha256"`
 	Mime      string `json:"mime"`
+	Size      int64  `json:"size"`
+
+	// Created is when the file was written for the first time.
+	Created time.Time `json:"created"`
+	// Modified is when the current content was written.
+	Modified time.Time `json:"modified"`
+	// Accessed is when the file was opened for reading or written for the last time.
+	Accessed time.Time `json:"accessed"`
+
+	// Attributes are user defined values, e.g. http headers or the source url.
+	Attributes map[string]string `json:"attributes,omitempty"`
+	// Incomplete is set for files written with OpenAppend until they are finalized.
+	Incomplete bool `json:"incomplete,omitempty"`
+	// Codec lists the codecs used to encode the local file, separated with commas.
+	Codec string `json:"codec,omitempty"`
+
+	// Version is the number of the version of the file, set only for the versioned overlays.
+	Version int `json:"version,omitempty"`
+	// Versions are the previous versions of the file from the oldest one.
+	Versions []*FileMetadata `json:"versions,omitempty"`
+}
+
+// WriteOption configures a single write.
+type WriteOption func(*writeOptions)
+
+type writeOptions struct {
+	attributes      map[string]string
+	mergeAttributes bool
+	incomplete      bool
+	timestamps      *FileMetadata
+	contentType     string
+}
+
+// WithAttributes sets user defined attributes for the written file, replacing the attributes of
+// the overwritten one. Empty values are ignored.
+func WithAttributes(attributes map[string]string) WriteOption {
+	return func(wo *writeOptions) {
+		wo.attributes = attributes
+	}
+}
+
+// WithMergedAttributes keeps the attributes of the overwritten file, the ones from WithAttributes
+// are applied to them like with SetAttributes. OpenAppend always does this.
+func WithMergedAttributes() WriteOption {
+	return func(wo *writeOptions) {
+		wo.mergeAttributes = true
+	}
+}
+
+// withIncomplete marks the written file as incomplete like OpenAppend does.
+func withIncomplete(incomplete bool) WriteOption {
+	return func(wo *writeOptions) {
+		wo.incomplete = incomplete
+	}
+}
+
+// withTimestamps keeps the timestamps from the given metadata instead of the write time.
+func withTimestamps(md *FileMetadata) WriteOption {
+	return func(wo *writeOptions) {
+		wo.timestamps = md
+	}
+}
+
+func newWriteOptions(options []WriteOption) *writeOptions {
+	wo := &writeOptions{}
+	for _, option := range options {
+		option(wo)
+	}
+	return wo
+}
+
+// mergeAttributes returns a copy of the attributes with the updates applied, an empty value
+// removes the attribute. Returns nil if no attributes left.
+func mergeAttributes(attributes map[string]string, updates map[string]string) map[string]string {
+	result := map[string]string{}
+	for k, v := range attributes {
+		result[k] = v
+	}
+	for k, v := range updates {
+		if v == "" {
+			delete(result, k)
+		} else {
+			result[k] = v
+		}
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+// inheritMetadata copies the creation time and, if requested, the attributes from the metadata of
+// the overwritten file, applying the write options.
+func inheritMetadata(fmd *FileMetadata, old *FileMetadata, wo *writeOptions) {
+	var oldAttributes map[string]string
+	if old != nil {
+		fmd.Created = old.Created
+		if wo.mergeAttributes {
+			oldAttributes = old.Attributes
+		}
+	}
+	fmd.Attributes = mergeAttributes(oldAttributes, wo.attributes)
+	fmd.Incomplete = wo.incomplete
+	if wo.timestamps != nil {
+		fmd.Created = wo.timestamps.Created
+		fmd.Modified = wo.timestamps.Modified
+		fmd.Accessed = wo.timestamps.Accessed
+	}
 }
 
 // Overlay is an extra layer between the filesystem (io) and the user code.
+//
+// All methods are safe for concurrent use, returned metadata must not be modified. A file written
+// with OpenWrite becomes visible only after Close, readers opened before that keep reading the
+// previous content. When several writers write the same file, the last one closed wins.
+// A single reader or writer must not be used from several goroutines at once.
 type Overlay interface {
 	OpenRead(name string) (io.ReadCloser, error)
-	OpenWrite(name string) (io.WriteCloser, error)
+	// OpenSeekable opens the file for reading with random access.
+	OpenSeekable(name string) (SeekableReader, error)
+	OpenWrite(name string, options ...WriteOption) (io.WriteCloser, error)
 	GetMetadata(names []string) []*FileMetadata
+
+	// Delete removes the file and its metadata, returns os.ErrNotExist if there is no such file.
+	Delete(name string) error
+	// Rename moves the file to a new name, replacing the existing file with the same name.
+	Rename(oldName string, newName string) error
+	// List returns metadata for all files which names start with the prefix, sorted by name.
+	List(prefix string) []*FileMetadata
+	// OpenAppend continues writing the file, creating it if needed. The file is marked as
+	// incomplete until Finalize is called. Existing content is copied and rehashed, the file is
+	// replaced on Close like with OpenWrite, keeping its attributes.
+	OpenAppend(name string, options ...WriteOption) (io.WriteCloser, error)
+	// Finalize marks the file written with OpenAppend as complete.
+	Finalize(name string) error
+	// SetAttributes updates user defined attributes of the file, an empty value removes the
+	// attribute.
+	SetAttributes(name string, attributes map[string]string) error
+	// Watch subscribes to the changes of the files with the given prefix made through the overlay,
+	// the watcher must be closed when not needed anymore.
+	Watch(prefix string) *Watcher
+}
+
+// SeekableReader reads the file content from any position.
+type SeekableReader interface {
+	io.ReadSeekCloser
+	io.ReaderAt
+
+	// Size returns the size of the file content in bytes.
+	Size() int64
+}
+
+// Walk calls fn for every file with the given prefix in the name order. Stops on the first
+// error returned by fn, fs.SkipAll stops walking without an error.
+func Walk(o Overlay, prefix string, fn func(*FileMetadata) error) error {
+	for _, md := range o.List(prefix) {
+		if err := fn(md); err != nil {
+			if err == fs.SkipAll {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
 }
 
 // OverlayMetadata contains a system information for the overlay (e.g. file list)
 type OverlayMetadata struct {
-	FileMetadata map[string]*FileMetadata `json:"fileMetadata"`
+	// SchemaVersion is the version of the metadata format, zero for the metadata written before
+	// the versions were introduced.
+	SchemaVersion int                      `json:"schemaVersion,omitempty"`
+	FileMetadata  map[string]*FileMetadata `json:"fileMetadata"`
+}
+
+type byteCounter struct {
+	count int64
+}
+
+func (bc *byteCounter) Write(b []byte) (int, error) {
+	bc.count += int64(len(b))
+	return len(b), nil
+}
+
+// newContentWriter forwards data to the writer, calculating sha256, mime type and size of the
+// content. After the writer is successfully closed, they are passed to onClose with the timestamps
+// set to now, the caller fills the names. Detect gets the first bytes of the content, the error
+// from onClose is returned by Close.
+func newContentWriter(w io.WriteCloser, now func() time.Time, detect func([]byte) string, onClose func(*FileMetadata) error) io.WriteCloser {
+	mimeBuffer := bytes.NewBuffer([]byte{})
+	sha := sha256.New()
+	size := &byteCounter{}
+	return NewMultiWriteCloser().
+		AddWriteCloser(w).
+		AddWriter(sha).
+		AddWriter(size).
+		AddWriter(FixedSizeWriter(mimeBuffer, mimeBlockSize)).
+		SetOnCloseError(func() error {
+			ts := now()
+			return onClose(&FileMetadata{
+				Sha256:   fmt.Sprintf("%x", sha.Sum(nil)),
+				Mime:     detect(mimeBuffer.Bytes()),
+				Size:     size.count,
+				Created:  ts,
+				Modified: ts,
+				Accessed: ts,
+			})
+		})
 }
 
+// LocalOverlayOption configures optional behavior of the local overlay.
+type LocalOverlayOption func(*localOverlay)
+
 type localOverlay struct {
 	Overlay
 
-	lock sync.Mutex
+	lock rootLock
 
-	marshal  *Marshaller[OverlayMetadata]
+	store    MetadataStore
 	metadata *OverlayMetadata
+	// pending are the changes not saved to the store yet.
+	pending map[string]*FileMetadata
+	// refs counts how many files use the same local file.
+	refs map[string]int
+	// writing are the temp files of the writes not closed yet.
+	writing map[string]bool
+	// accessed are the access times of the reads made under the read lock, they are applied to the
+	// metadata before the next change.
+	accessed   map[*FileMetadata]time.Time
+	accessLock sync.Mutex
+
+	eviction    *EvictionPolicy
+	versioning  *VersionLimits
+	upgrades    []metadataUpgrade
+	now         func() time.Time
+	codecs      []Codec
+	knownCodecs map[string]Codec
 
-	root string
+	watchers         watchers
+	detector         ContentTypeDetector
+	naming           NamingStrategy
+	contentAddressed bool
+	readOnly         bool
+	shared           bool
+	shardDepth       int
+	root             string
 }
 
 func (lo *localOverlay) resolve(path ...string) string {
 	return filepath.Join(append([]string{lo.root}, path...)...)
 }
 
-func (lo *localOverlay) safeName(name string) string {
-	h := fnv.New32a()
-	h.Write([]byte(name))
-	nameHash := fmt.Sprintf("%x", h.Sum([]byte{}))
+// takenBy returns a check if the local name is used by a file other than the given one or
+// conflicts with the existing local files and folders, the lock must be held by the caller.
+func (lo *localOverlay) takenBy(name string) func(string) bool {
+	return func(localName string) bool {
+		localName = lo.shard(localName)
+		if md, ok := lo.metadata.FileMetadata[name]; ok && md.LocalName == localName {
+			return false
+		}
+		if lo.refs[localName] > 0 || strings.Split(localName, "/")[0] == systemFolderName {
+			return true
+		}
+		// A parent being a file is reported as an error other than os.ErrNotExist
+		_, err := os.Stat(lo.resolve(localName))
+		return !os.IsNotExist(err)
+	}
+}
 
-	newName := nonAlphanumericRegex.ReplaceAllString(name, "_")
-	if len(newName) > maxNameLength-len(nameHash)-1 {
-		newName = newName[len(newName)-maxNameLength+len(nameHash):]
+// localName returns a name for the local file that keeps the file with the given name and hash,
+// the lock must be held by the caller.
+func (lo *localOverlay) localName(name string, sha256 string, codec string) string {
+	if lo.contentAddressed {
+		if codec != "" {
+			// Same content encoded differently cannot share the local file
+			return lo.shard(sha256 + "_" + nonAlphanumericRegex.ReplaceAllString(codec, "_"))
+		}
+		return lo.shard(sha256)
 	}
-	return nameHash + "_" + newName
+	localName := lo.naming.LocalName(name, lo.takenBy(name))
+	if !isLocalName(localName) {
+		// Custom strategies must not write outside the root
+		localName = NewHashedNaming().LocalName(name, lo.takenBy(name))
+	}
+	return lo.shard(localName)
 }
 
-func (lo *localOverlay) saveMetadata(fmd *FileMetadata) error {
-	lo.lock.Lock()
-	defer lo.lock.Unlock()
+// moveLocal moves the file to the given local name, creating parent folders if needed.
+func (lo *localOverlay) moveLocal(path string, localName string) error {
+	target := lo.resolve(localName)
+	if err := os.MkdirAll(filepath.Dir(target), defaultDirPermissions); err != nil {
+		return err
+	}
+	return os.Rename(path, target)
+}
 
-	if lo.metadata == nil {
-		lo.metadata = &OverlayMetadata{
-			FileMetadata: map[string]*FileMetadata{},
-		}
+// setAside keeps the local file of the entry under another local name while it is being replaced,
+// moving it there if links are not supported. The move is recorded in the journal first, so it is
+// undone on start if the process crashes before the change is saved. A missing local file is
+// ignored, there is nothing to keep.
+func (lo *localOverlay) setAside(md *FileMetadata, aside string, j *journal) error {
+	if err := j.record(journalMove{LocalName: md.LocalName, Backup: aside, Sha256: md.Sha256, Codec: md.Codec}); err != nil {
+		return err
+	}
+	target := lo.resolve(aside)
+	if err := os.MkdirAll(filepath.Dir(target), defaultDirPermissions); err != nil {
+		return err
 	}
+	if os.Link(lo.resolve(md.LocalName), target) == nil {
+		return nil
+	}
+	if err := os.Rename(lo.resolve(md.LocalName), target); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
 
-	if lo.metadata.FileMetadata == nil {
-		lo.metadata.FileMetadata = map[string]*FileMetadata{}
+// copyLocal puts the content of the local file under another local name, replacing the existing
+// file atomically. The file is linked if possible and copied otherwise, the source is kept.
+func (lo *localOverlay) copyLocal(localName string, newLocalName string) error {
+	f, err := os.CreateTemp(lo.resolve(systemFolderName, tempFolderName), "copy-*")
+	if err != nil {
+		return err
+	}
+	tempFile := f.Name()
+	f.Close()
+	os.Remove(tempFile)
+	if os.Link(lo.resolve(localName), tempFile) != nil {
+		if err := copyFile(lo.resolve(localName), tempFile); err != nil {
+			os.Remove(tempFile)
+			return err
+		}
+	}
+	if err := lo.moveLocal(tempFile, newLocalName); err != nil {
+		os.Remove(tempFile)
+		return err
 	}
+	return nil
+}
 
-	lo.metadata.FileMetadata[fmd.Name] = fmd
-	data, err := lo.marshal.Marshal(lo.metadata)
+func copyFile(source string, target string) error {
+	src, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, defaultPermissions)
 	if err != nil {
 		return err
 	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return (&syncedFile{dst}).Close()
+}
+
+// setEntry replaces the metadata for the name, nil metadata removes the entry. The change is
+// saved with the next writeMetadata call. Returns local files that might become unused, the lock
+// must be held by the caller.
+func (lo *localOverlay) setEntry(name string, md *FileMetadata) []string {
+	lo.pending[name] = md
+	unused := []string{}
+	if old, ok := lo.metadata.FileMetadata[name]; ok {
+		for _, localName := range localNames(old) {
+			lo.refs[localName]--
+			if lo.refs[localName] <= 0 {
+				delete(lo.refs, localName)
+				unused = append(unused, localName)
+			}
+		}
+		delete(lo.metadata.FileMetadata, name)
+	}
+	if md != nil {
+		lo.metadata.FileMetadata[name] = md
+		for _, localName := range localNames(md) {
+			lo.refs[localName]++
+		}
+	}
+	return unused
+}
+
+// removeUnused deletes local files that are not referenced by any entry anymore.
+func (lo *localOverlay) removeUnused(localNames []string) error {
+	for _, localName := range localNames {
+		if lo.refs[localName] > 0 {
+			continue
+		}
+		if err := os.Remove(lo.resolve(localName)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		// Nested local names leave empty folders, removal stops at the first non-empty one
+		for dir := path.Dir(localName); dir != "."; dir = path.Dir(dir) {
+			if os.Remove(lo.resolve(dir)) != nil {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// writeMetadata saves the pending changes to the store, the lock must be held by the caller.
+// Changes are dropped even if saving fails, the caller reverts them with setEntry.
+func (lo *localOverlay) writeMetadata() error {
+	if err := lo.checkWritable(); err != nil {
+		lo.pending = map[string]*FileMetadata{}
+		return err
+	}
+	if err := lo.lock.changing(); err != nil {
+		lo.pending = map[string]*FileMetadata{}
+		return err
+	}
+	names := []string{}
+	for name := range lo.pending {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	changes := make([]MetadataChange, len(names))
+	for i, name := range names {
+		changes[i] = MetadataChange{Name: name, Metadata: lo.pending[name]}
+	}
+	lo.pending = map[string]*FileMetadata{}
+	return lo.store.Save(lo.metadata, changes)
+}
+
+// publish moves the written temporary file in place and saves its metadata. In the
+// content-addressed mode the file is dropped if there is already a local file with same content.
+func (lo *localOverlay) publish(tempFile string, fmd *FileMetadata, wo *writeOptions) error {
+	lo.lock.Lock()
+	evicted, err := lo.publishLocked(tempFile, fmd, wo)
+	lo.lock.Unlock()
 
-	return os.WriteFile(filepath.Join(lo.root, systemFolderName, metadataFileName), data, defaultPermissions)
+	lo.notifyEvicted(evicted)
+	return err
 }
 
+func (lo *localOverlay) publishLocked(tempFile string, fmd *FileMetadata, wo *writeOptions) ([]*FileMetadata, error) {
+	if err := lo.checkSize(fmd); err != nil {
+		os.Remove(tempFile)
+		return nil, err
+	}
+	fmd.LocalName = lo.localName(fmd.Name, fmd.Sha256, fmd.Codec)
+	old := lo.metadata.FileMetadata[fmd.Name]
+	version := lo.addVersion(fmd, old)
+	lo.fitVersions(fmd)
+	// The overwritten local file is set aside, so the replacement stays atomic and could be undone
+	var j *journal
+	aside := version
+	if old != nil && !lo.contentAddressed && old.LocalName == fmd.LocalName {
+		var err error
+		if j, err = lo.newJournal(); err != nil {
+			os.Remove(tempFile)
+			return nil, err
+		}
+		defer j.close(lo)
+		if aside == "" {
+			aside = j.backup
+		}
+		if err := lo.setAside(old, aside, j); err != nil {
+			os.Remove(tempFile)
+			return nil, err
+		}
+	}
+
+	placed := false
+	// The new file is removed and the previous one goes back to its place if the write fails
+	rollback := func() {
+		if placed {
+			os.Remove(lo.resolve(fmd.LocalName))
+		}
+		if j != nil {
+			os.Rename(lo.resolve(aside), lo.resolve(old.LocalName))
+		}
+	}
+
+	if lo.contentAddressed && lo.refs[fmd.LocalName] > 0 {
+		os.Remove(tempFile)
+	} else if err := lo.moveLocal(tempFile, fmd.LocalName); err != nil {
+		os.Remove(tempFile)
+		rollback()
+		return nil, err
+	} else {
+		placed = true
+	}
+
+	inheritMetadata(fmd, old, wo)
+	unused := lo.setEntry(fmd.Name, fmd)
+	evicted, evictedUnused := lo.evict()
+	if err := lo.writeMetadata(); err != nil {
+		for _, md := range evicted {
+			lo.setEntry(md.Name, md)
+		}
+		lo.setEntry(fmd.Name, old)
+		rollback()
+		return nil, err
+	}
+	lo.watchers.notify(changeEvent(old, fmd))
+	if version != "" {
+		// The version set aside could be pruned right away
+		unused = append(unused, version)
+	}
+	return evicted, lo.removeUnused(append(unused, evictedUnused...))
+}
+
+// OpenRead opens the file for reading and updates its access time. The access time is kept in
+// memory and saved with the next metadata update.
 func (lo *localOverlay) OpenRead(name string) (io.ReadCloser, error) {
-	if lo.metadata == nil || lo.metadata.FileMetadata == nil || lo.metadata.FileMetadata[name] == nil {
-		return nil, os.ErrNotExist
+	f, md, err := lo.openLocalFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return lo.decode(f, md)
+}
+
+// OpenSeekable reads encoded files into memory, because they cannot be decoded from any position.
+func (lo *localOverlay) OpenSeekable(name string) (SeekableReader, error) {
+	f, md, err := lo.openLocalFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if md.Codec == "" {
+		return &localFileReader{File: f, size: md.Size}, nil
 	}
-	md := lo.metadata.FileMetadata[name]
-	f, err := os.Open(lo.resolve(md.LocalName))
+
+	r, err := lo.decode(f, md)
 	if err != nil {
 		return nil, err
 	}
-	return io.ReadCloser(f), nil
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return &memoryReader{bytes.NewReader(data)}, nil
 }
 
-func (lo *localOverlay) OpenWrite(name string) (io.WriteCloser, error) {
-	lo.lock.Lock()
-	defer lo.lock.Unlock()
+type localFileReader struct {
+	*os.File
+
+	size int64
+}
+
+func (lfr *localFileReader) Size() int64 {
+	return lfr.size
+}
+
+// openLocalFile opens the local file for the file with the given name, evicting it if expired.
+// Reads share the lock, only the expired entries are removed with the lock held exclusively.
+func (lo *localOverlay) openLocalFile(name string) (*os.File, *FileMetadata, error) {
+	for {
+		lo.lock.RLock()
+		md := lo.metadata.FileMetadata[name]
+		if md == nil {
+			lo.lock.RUnlock()
+			return nil, nil, os.ErrNotExist
+		}
+		if !lo.isExpired(md) {
+			f, err := os.Open(lo.resolve(md.LocalName))
+			if err != nil {
+				lo.lock.RUnlock()
+				return nil, nil, err
+			}
+			accessed := lo.recordAccess(md)
+			lo.lock.RUnlock()
+			return f, accessed, nil
+		}
+		lo.lock.RUnlock()
+
+		// The entry replaced before the lock is taken is read again
+		expired, err := lo.expire(md)
+		if expired != nil {
+			if err == nil {
+				lo.notifyEvicted([]*FileMetadata{expired})
+			}
+			return nil, nil, os.ErrNotExist
+		}
+	}
+}
+
+// recordAccess keeps the access time of the entry until the next change and returns the entry
+// with it. The read lock must be held by the caller.
+func (lo *localOverlay) recordAccess(md *FileMetadata) *FileMetadata {
+	now := lo.now()
+	lo.accessLock.Lock()
+	if now.After(lo.accessed[md]) {
+		lo.accessed[md] = now
+	}
+	lo.accessLock.Unlock()
+
+	accessed := *md
+	accessed.Accessed = now
+	return &accessed
+}
+
+// withAccessTime returns the entry with the access time recorded since the last change. The read
+// lock must be held by the caller.
+func (lo *localOverlay) withAccessTime(md *FileMetadata) *FileMetadata {
+	lo.accessLock.Lock()
+	defer lo.accessLock.Unlock()
+
+	at, ok := lo.accessed[md]
+	if md == nil || !ok {
+		return md
+	}
+	accessed := *md
+	accessed.Accessed = at
+	return &accessed
+}
+
+// flushAccessTimes applies the recorded access times to the entries that did not change since
+// the reads, so they are saved with the next metadata update. The lock must be held by the caller.
+func (lo *localOverlay) flushAccessTimes() {
+	lo.accessLock.Lock()
+	defer lo.accessLock.Unlock()
+
+	for md, at := range lo.accessed {
+		if lo.metadata.FileMetadata[md.Name] == md && at.After(md.Accessed) {
+			accessed := *md
+			accessed.Accessed = at
+			lo.setEntry(md.Name, &accessed)
+		}
+	}
+	lo.accessed = map[*FileMetadata]time.Time{}
+}
+
+// OpenWrite writes data into a temporary file, which replaces the actual file on Close, so the
+// file is never seen half-written.
+func (lo *localOverlay) OpenWrite(name string, options ...WriteOption) (io.WriteCloser, error) {
+	w, _, err := lo.openWrite(name, newWriteOptions(options))
+	return w, err
+}
+
+func (lo *localOverlay) openWrite(name string, wo *writeOptions) (io.WriteCloser, *os.File, error) {
+	fwc, err := lo.createTemp()
+	if err != nil {
+		return nil, nil, err
+	}
+	encoded, err := encode(&syncedFile{fwc}, lo.codecs)
+	if err != nil {
+		lo.untrack(fwc.Name())
+		os.Remove(fwc.Name())
+		return nil, nil, err
+	}
 
-	safe := lo.safeName(name)
-	fwc, err := os.OpenFile(lo.resolve(safe), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, defaultPermissions)
+	codec := codecNames(lo.codecs)
+	return &trackedWriter{
+		WriteCloser: newContentWriter(encoded, lo.now, wo.detectWith(lo.detector, name), func(fmd *FileMetadata) error {
+			fmd.Name = name
+			fmd.Codec = codec
+			return lo.publish(fwc.Name(), fmd, wo)
+		}),
+		onClose: func() {
+			lo.untrack(fwc.Name())
+		},
+		onAbort: func() {
+			fwc.Close()
+			os.Remove(fwc.Name())
+		},
+	}, fwc, nil
+}
+
+func (lo *localOverlay) OpenAppend(name string, options ...WriteOption) (io.WriteCloser, error) {
+	wo := newWriteOptions(options)
+	wo.incomplete = true
+	wo.mergeAttributes = true
+	w, fwc, err := lo.openWrite(name, wo)
 	if err != nil {
 		return nil, err
 	}
 
-	mimeBuffer := bytes.NewBuffer([]byte{})
-	sha := sha256.New()
-	return NewMultiWriteCloser().
-		AddWriteCloser(fwc).
-		AddWriter(sha).
-		AddWriter(FixedSizeWriter(mimeBuffer, mimeBlockSize)).
-		SetOnClose(func() {
-			lo.saveMetadata(&FileMetadata{
-				Name:      name,
-				LocalName: safe,
-				Sha256:    fmt.Sprintf("%x", sha.Sum(nil)),
-				Mime:      http.DetectContentType(mimeBuffer.Bytes()),
-			})
-		}), nil
+	existing, err := lo.OpenRead(name)
+	if os.IsNotExist(err) {
+		return w, nil
+	} else if err == nil {
+		_, err = io.Copy(w, existing)
+		existing.Close()
+	}
+	if err != nil {
+		fwc.Close()
+		lo.untrack(fwc.Name())
+		os.Remove(fwc.Name())
+		return nil, err
+	}
+	return w, nil
 }
 
-func (lo *localOverlay) GetMetadata(names []string) []*FileMetadata {
+func (lo *localOverlay) Finalize(name string) error {
 	lo.lock.Lock()
 	defer lo.lock.Unlock()
+
+	md, ok := lo.metadata.FileMetadata[name]
+	if !ok {
+		return os.ErrNotExist
+	}
+	if !md.Incomplete {
+		return nil
+	}
+	finalized := *md
+	finalized.Incomplete = false
+	lo.setEntry(name, &finalized)
+	if err := lo.writeMetadata(); err != nil {
+		lo.setEntry(name, md)
+		return err
+	}
+	lo.watchers.notify(Event{Type: EventUpdated, Metadata: &finalized})
+	return nil
+}
+
+func (lo *localOverlay) GetMetadata(names []string) []*FileMetadata {
+	lo.lock.RLock()
+	defer lo.lock.RUnlock()
 	result := make([]*FileMetadata, len(names))
 	for i, name := range names {
-		result[i] = lo.metadata.FileMetadata[name]
+		result[i] = lo.withAccessTime(lo.metadata.FileMetadata[name])
 	}
 	return result
 }
 
-func NewLocalOverlay(root string, marshaller *Marshaller[OverlayMetadata]) (Overlay, error) {
-	systemFolder := filepath.Join(root, systemFolderName)
-	metadataFile := filepath.Join(systemFolder, metadataFileName)
-	if err := os.MkdirAll(systemFolder, defaultDirPermissions); err != nil && err != os.ErrExist {
-		return nil, err
+func (lo *localOverlay) Delete(name string) error {
+	lo.lock.Lock()
+	defer lo.lock.Unlock()
+
+	md, ok := lo.metadata.FileMetadata[name]
+	if !ok {
+		return os.ErrNotExist
+	}
+	unused := lo.setEntry(name, nil)
+	if err := lo.writeMetadata(); err != nil {
+		lo.setEntry(name, md)
+		return err
 	}
+	lo.watchers.notify(Event{Type: EventDeleted, Metadata: md})
+	return lo.removeUnused(unused)
+}
 
-	if _, err := os.Stat(metadataFile); os.IsNotExist(err) {
-		if err = os.WriteFile(metadataFile, []byte("{}"), defaultPermissions); err != nil {
-			return nil, err
+func (lo *localOverlay) Rename(oldName string, newName string) error {
+	lo.lock.Lock()
+	defer lo.lock.Unlock()
+
+	md, ok := lo.metadata.FileMetadata[oldName]
+	if !ok {
+		return os.ErrNotExist
+	}
+	if oldName == newName {
+		return nil
+	}
+	if err := lo.checkWritable(); err != nil {
+		return err
+	}
+
+	renamed := *md
+	renamed.Name = newName
+	renamed.LocalName = lo.localName(newName, md.Sha256, md.Codec)
+	replaced := lo.metadata.FileMetadata[newName]
+	// The local file of the replaced entry is set aside to put it back if the rename fails
+	var j *journal
+	if replaced != nil && renamed.LocalName != md.LocalName && replaced.LocalName == renamed.LocalName {
+		var err error
+		if j, err = lo.newJournal(); err != nil {
+			return err
+		}
+		defer j.close(lo)
+		if err := lo.setAside(replaced, j.backup, j); err != nil {
+			return err
+		}
+	}
+	placed := false
+	rollback := func() {
+		if placed {
+			os.Remove(lo.resolve(renamed.LocalName))
+		}
+		if j != nil {
+			os.Rename(lo.resolve(j.backup), lo.resolve(replaced.LocalName))
 		}
 	}
+	// The old local file is removed only after the metadata is saved, so the entry keeps its
+	// content if the process crashes before that
+	if renamed.LocalName != md.LocalName {
+		if err := lo.copyLocal(md.LocalName, renamed.LocalName); err != nil {
+			rollback()
+			return err
+		}
+		placed = true
+	}
 
-	data, err := os.ReadFile(metadataFile)
-	if err != nil {
-		return nil, err
+	unused := append(lo.setEntry(oldName, nil), lo.setEntry(newName, &renamed)...)
+	if err := lo.writeMetadata(); err != nil {
+		lo.setEntry(newName, replaced)
+		lo.setEntry(oldName, md)
+		rollback()
+		return err
 	}
+	lo.watchers.notify(Event{Type: EventDeleted, Metadata: md}, changeEvent(replaced, &renamed))
+	return lo.removeUnused(unused)
+}
+
+func (lo *localOverlay) SetAttributes(name string, attributes map[string]string) error {
+	lo.lock.Lock()
+	defer lo.lock.Unlock()
 
-	mdata, err := marshaller.Unmarshal(data)
+	md, ok := lo.metadata.FileMetadata[name]
+	if !ok {
+		return os.ErrNotExist
+	}
+	updated := *md
+	updated.Attributes = mergeAttributes(md.Attributes, attributes)
+	lo.setEntry(name, &updated)
+	if err := lo.writeMetadata(); err != nil {
+		lo.setEntry(name, md)
+		return err
+	}
+	lo.watchers.notify(Event{Type: EventUpdated, Metadata: &updated})
+	return nil
+}
+
+func (lo *localOverlay) Watch(prefix string) *Watcher {
+	return lo.watchers.watch(prefix)
+}
+
+func (lo *localOverlay) List(prefix string) []*FileMetadata {
+	lo.lock.RLock()
+	defer lo.lock.RUnlock()
+
+	result := []*FileMetadata{}
+	for name, md := range lo.metadata.FileMetadata {
+		if strings.HasPrefix(name, prefix) {
+			result = append(result, lo.withAccessTime(md))
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// loadMetadata replaces the metadata with the stored one upgraded to the current schema version,
+// returns true if it has to be saved. The lock must be held by the caller.
+func (lo *localOverlay) loadMetadata() (bool, error) {
+	mdata, err := lo.store.Load()
+	isNew := os.IsNotExist(err)
+	if isNew {
+		mdata = &OverlayMetadata{SchemaVersion: len(lo.upgrades)}
+	} else if err != nil {
+		return false, err
+	}
+	if mdata.FileMetadata == nil {
+		mdata.FileMetadata = map[string]*FileMetadata{}
+	}
+	upgraded, err := lo.upgrade(mdata)
 	if err != nil {
-		return nil, err
+		return false, err
+	}
+
+	lo.metadata = mdata
+	lo.refs = map[string]int{}
+	for name, md := range mdata.FileMetadata {
+		for _, localName := range localNames(md) {
+			lo.refs[localName]++
+		}
+		if upgraded {
+			lo.pending[name] = md
+		}
 	}
+	return isNew || upgraded, nil
+}
 
+// NewLocalOverlay opens an overlay in the root folder creating it if needed. Leftovers of the
+// writes interrupted by a crash are removed, metadata is restored from the last complete version
+// and the local files replaced by the changes that were not saved are put back.
+// Metadata of older schema versions is upgraded and saved, newer versions are refused with
+// ErrUnsupportedSchema.
+func NewLocalOverlay(root string, marshaller *Marshaller[OverlayMetadata], options ...LocalOverlayOption) (Overlay, error) {
+	systemFolder := filepath.Join(root, systemFolderName)
 	ol := &localOverlay{
-		root:     root,
-		lock:     sync.Mutex{},
-		marshal:  marshaller,
-		metadata: mdata,
+		root:        root,
+		store:       NewSnapshotMetadataStore(filepath.Join(systemFolder, metadataFileName), marshaller),
+		pending:     map[string]*FileMetadata{},
+		refs:        map[string]int{},
+		writing:     map[string]bool{},
+		accessed:    map[*FileMetadata]time.Time{},
+		now:         time.Now,
+		knownCodecs: map[string]Codec{},
+		naming:      NewHashedNaming(),
+		detector:    NewHTTPContentTypeDetector(),
+		upgrades:    metadataUpgrades,
+	}
+	ol.lock.flush = ol.flushAccessTimes
+	defaultStore := ol.store
+	for _, option := range options {
+		option(ol)
+	}
+	// Without the log store option, the root written with it would look empty
+	if ol.store == defaultStore && hasMetadataLog(ol.resolve(systemFolderName, metadataLogFileName)) {
+		WithLogMetadataStore()(ol)
+	}
+	if store, ok := ol.store.(readOnlyStore); ok && ol.readOnly {
+		store.setReadOnly()
+	}
+
+	if !ol.readOnly {
+		tempFolder := filepath.Join(systemFolder, tempFolderName)
+		// Temp files of a shared root could belong to the writes of other processes
+		if !ol.shared {
+			if err := os.RemoveAll(tempFolder); err != nil {
+				return nil, err
+			}
+		}
+		if err := os.MkdirAll(tempFolder, defaultDirPermissions); err != nil && err != os.ErrExist {
+			return nil, err
+		}
+	}
+	if ol.shared {
+		if err := ol.openLockFile(); err != nil {
+			return nil, err
+		}
+	}
+	if err := ol.start(); err != nil {
+		ol.Close()
+		return nil, err
 	}
 	return ol, nil
 }
+
+// start loads the metadata, saving it if it is new or was upgraded.
+func (lo *localOverlay) start() error {
+	lo.lock.Lock()
+	defer lo.lock.Unlock()
+
+	if lo.lock.err != nil {
+		return lo.lock.err
+	}
+	changed, err := lo.loadMetadata()
+	if err != nil {
+		return err
+	}
+	if !lo.readOnly {
+		if err := lo.recoverJournals(); err != nil {
+			return err
+		}
+	}
+	if changed && !lo.readOnly {
+		return lo.writeMetadata()
+	}
+	return nil
+}
+
+// NewContentAddressedOverlay creates a local overlay that keeps local files named by their sha256,
+// so files with the same content share a single local file, which is removed with the last of them.
+func NewContentAddressedOverlay(root string, marshaller *Marshaller[OverlayMetadata], options ...LocalOverlayOption) (Overlay, error) {
+	return NewLocalOverlay(root, marshaller, append(options, WithContentAddressing())...)
+}
+
+// WithContentAddressing stores local files by their sha256 instead of the file name.
+func WithContentAddressing() LocalOverlayOption {
+	return func(lo *localOverlay) {
+		lo.contentAddressed = true
+	}
+}
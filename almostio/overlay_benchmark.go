@@ -8,8 +8,15 @@ import (
 )
 
 func BenchmarkOverlayPerformance(bt *testing.B) {
+	benchmarkOverlay(bt)
+}
+
+func BenchmarkOverlayLogMetadataPerformance(bt *testing.B) {
+	benchmarkOverlay(bt, WithLogMetadataStore())
+}
 
-	o, err := NewLocalOverlay(filepath.Join(bt.TempDir(), "overlay_root"), NewJsonMarshal[OverlayMetadata]())
+func benchmarkOverlay(bt *testing.B, options ...LocalOverlayOption) {
+	o, err := NewLocalOverlay(filepath.Join(bt.TempDir(), "overlay_root"), NewJsonMarshal[OverlayMetadata](), options...)
 	if err != nil {
 		bt.Errorf("Cannot create test folder: %s", err)
 		return
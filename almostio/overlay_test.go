@@ -2,12 +2,16 @@ package almostio
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"fmt"
 	"io"
+	"io/fs"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 )
 
 type FakeWriteCloser struct {
@@ -128,6 +132,47 @@ func TestMultiWriteCloserRegressions(t *testing.T) {
 			t.Errorf("OnClose was not called during close")
 		}
 	})
+
+	t.Run("Close returns the onClose error", func(t *testing.T) {
+		fwc := &FakeWriteCloser{}
+		mwc := NewMultiWriteCloser().
+			AddWriteCloser(fwc).
+			SetOnCloseError(func() error {
+				return os.ErrPermission
+			})
+
+		if err := mwc.Close(); err != os.ErrPermission {
+			t.Errorf("Expected onClose error, but got %v", err)
+		}
+		if !fwc.Closed {
+			t.Errorf("Expected writers to be closed before onClose")
+		}
+	})
+
+	t.Run("Fixed size writer accepts writes after it is full", func(t *testing.T) {
+		buffer := bytes.NewBuffer([]byte{})
+		mwc := NewMultiWriteCloser().AddWriter(FixedSizeWriter(buffer, 4))
+
+		for _, b := range [][]byte{{1, 2, 3}, {4, 5, 6}, {7, 8, 9}} {
+			if _, err := mwc.Write(b); err != nil {
+				t.Errorf("Error when writing bytes: %s", err)
+			}
+		}
+		if !bytes.Equal(buffer.Bytes(), []byte{1, 2, 3, 4}) {
+			t.Errorf("Expected only first 4 bytes to be written, but got %v", buffer.Bytes())
+		}
+	})
+}
+
+func withoutTimestamps(md *FileMetadata) *FileMetadata {
+	if md == nil {
+		return nil
+	}
+	result := *md
+	result.Created = time.Time{}
+	result.Modified = time.Time{}
+	result.Accessed = time.Time{}
+	return &result
 }
 
 type sampleFile struct {
@@ -200,6 +245,7 @@ func TestOverlay(t *testing.T) {
 				LocalName: "d4ae358f_Whatever",
 				Sha256:    "039058c6f2c0cb492c533b0a4d14ef77cc0f78abccced5287d84a1a2011cfb81",
 				Mime:      "application/octet-stream",
+				Size:      3,
 			}},
 		},
 		{
@@ -213,6 +259,7 @@ func TestOverlay(t *testing.T) {
 				LocalName: "89493756_A_spaces_file_name",
 				Sha256:    "74f81fe167d99b4cb41d6d0ccda82278caee9f3e2f25d5e5a3936ff3dcec60d0",
 				Mime:      "application/octet-stream",
+				Size:      5,
 			}},
 		},
 		{
@@ -226,6 +273,7 @@ func TestOverlay(t *testing.T) {
 				LocalName: "7ab716af__",
 				Sha256:    "74f81fe167d99b4cb41d6d0ccda82278caee9f3e2f25d5e5a3936ff3dcec60d0",
 				Mime:      "application/octet-stream",
+				Size:      5,
 			}},
 		},
 		{
@@ -239,6 +287,7 @@ func TestOverlay(t *testing.T) {
 				LocalName: "d7aeb9d2_some_file_path",
 				Sha256:    "74f81fe167d99b4cb41d6d0ccda82278caee9f3e2f25d5e5a3936ff3dcec60d0",
 				Mime:      "application/octet-stream",
+				Size:      5,
 			}},
 		},
 		{
@@ -252,6 +301,7 @@ func TestOverlay(t *testing.T) {
 				LocalName: "d78d0606_some_empty_file",
 				Sha256:    "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
 				Mime:      "text/plain; charset=utf-8",
+				Size:      0,
 			}},
 		},
 		{
@@ -266,12 +316,14 @@ func TestOverlay(t *testing.T) {
 					LocalName: "644fe258_File_1",
 					Sha256:    "039058c6f2c0cb492c533b0a4d14ef77cc0f78abccced5287d84a1a2011cfb81",
 					Mime:      "application/octet-stream",
+					Size:      3,
 				},
 				{
 					Name:      "File 2",
 					LocalName: "674fe711_File_2",
 					Sha256:    "787c798e39a5bc1910355bae6d0cd87a36b2e10fd0202a83e3bb6b005da83472",
 					Mime:      "application/octet-stream",
+					Size:      3,
 				},
 			},
 		},
@@ -289,6 +341,7 @@ func TestOverlay(t *testing.T) {
 				LocalName: "644fe258_File_1",
 				Sha256:    "787c798e39a5bc1910355bae6d0cd87a36b2e10fd0202a83e3bb6b005da83472",
 				Mime:      "application/octet-stream",
+				Size:      3,
 			}},
 		},
 		{
@@ -318,6 +371,7 @@ func TestOverlay(t *testing.T) {
 				LocalName: "644fe258_File_1",
 				Sha256:    "836c5e8c94b74be78456122528bb2a44b4cf61b3922f211e2bae5bf327f95f09",
 				Mime:      "image/png",
+				Size:      67,
 			}},
 		},
 	} {
@@ -370,7 +424,7 @@ func TestOverlay(t *testing.T) {
 					t.Errorf("Expected metadata to have length %d, but got %d", len(md), len(tc.expectedMetadata))
 				}
 				for i, mdata := range md {
-					if !reflect.DeepEqual(tc.expectedMetadata[i], mdata) {
+					if !reflect.DeepEqual(tc.expectedMetadata[i], withoutTimestamps(mdata)) {
 						t.Errorf("Metadata for %s differs", names[i])
 					}
 				}
@@ -378,3 +432,758 @@ func TestOverlay(t *testing.T) {
 		})
 	}
 }
+
+type fakeClock struct {
+	now time.Time
+}
+
+// newFakeClock returns a clock stopped at the start of 2024.
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (fc *fakeClock) Now() time.Time {
+	return fc.now
+}
+
+func (fc *fakeClock) Advance(d time.Duration) {
+	fc.now = fc.now.Add(d)
+}
+
+// withClock makes the overlay take the time from the fake clock.
+func withClock(clock *fakeClock) LocalOverlayOption {
+	return func(lo *localOverlay) {
+		lo.now = clock.Now
+	}
+}
+
+// newTestOverlay opens a local overlay in the root, a new temp folder is used if the root is empty.
+func newTestOverlay(t *testing.T, root string, options ...LocalOverlayOption) *localOverlay {
+	if root == "" {
+		root = filepath.Join(t.TempDir(), "overlay_root")
+	}
+	o, err := NewLocalOverlay(root, NewJsonMarshal[OverlayMetadata](), options...)
+	if err != nil {
+		t.Fatalf("Error while starting an overlay: %v", err)
+	}
+	lo := o.(*localOverlay)
+	t.Cleanup(func() { lo.Close() })
+	return lo
+}
+
+func writeOverlayFile(o Overlay, name string, content []byte) error {
+	wc, err := o.OpenWrite(name)
+	if err != nil {
+		return err
+	}
+	if _, err := wc.Write(content); err != nil {
+		return err
+	}
+	return wc.Close()
+}
+
+func readOverlayFile(o Overlay, name string) ([]byte, error) {
+	rc, err := o.OpenRead(name)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+func localFiles(t *testing.T, root string) []string {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatalf("Cannot list overlay root %s: %s", root, err)
+	}
+	result := []string{}
+	for _, e := range entries {
+		if e.Name() != systemFolderName {
+			result = append(result, e.Name())
+		}
+	}
+	return result
+}
+
+func TestOverlayModification(t *testing.T) {
+
+	newOverlay := func(t *testing.T, files ...string) (Overlay, string) {
+		root := filepath.Join(t.TempDir(), "overlay_root")
+		o, err := NewLocalOverlay(root, NewJsonMarshal[OverlayMetadata]())
+		if err != nil {
+			t.Fatalf("Error while starting an overlay: %v", err)
+		}
+		for _, f := range files {
+			if err := writeOverlayFile(o, f, []byte(f)); err != nil {
+				t.Fatalf("Cannot write file %s: %s", f, err)
+			}
+		}
+		return o, root
+	}
+
+	t.Run("Delete removes file and metadata", func(t *testing.T) {
+		o, root := newOverlay(t, "File 1", "File 2")
+		if err := o.Delete("File 1"); err != nil {
+			t.Errorf("Cannot delete file: %s", err)
+		}
+		if _, err := o.OpenRead("File 1"); !os.IsNotExist(err) {
+			t.Errorf("Expected deleted file to not exist, but got %v", err)
+		}
+		if md := o.GetMetadata([]string{"File 1"}); md[0] != nil {
+			t.Errorf("Expected no metadata for deleted file, but got %v", md[0])
+		}
+		if files := localFiles(t, root); !reflect.DeepEqual(files, []string{"674fe711_File_2"}) {
+			t.Errorf("Expected only one local file to stay, but got %v", files)
+		}
+
+		reopened, _ := NewLocalOverlay(root, NewJsonMarshal[OverlayMetadata]())
+		if list := reopened.List(""); len(list) != 1 || list[0].Name != "File 2" {
+			t.Errorf("Expected deletion to be persisted, but got %v", list)
+		}
+	})
+
+	t.Run("Delete non-existing file", func(t *testing.T) {
+		o, _ := newOverlay(t, "File 1")
+		if err := o.Delete("File 2"); !os.IsNotExist(err) {
+			t.Errorf("Expected os.ErrNotExist, but got %v", err)
+		}
+	})
+
+	t.Run("Rename moves file and metadata", func(t *testing.T) {
+		o, root := newOverlay(t, "File 1")
+		if err := o.Rename("File 1", "File 2"); err != nil {
+			t.Errorf("Cannot rename file: %s", err)
+		}
+		if _, err := o.OpenRead("File 1"); !os.IsNotExist(err) {
+			t.Errorf("Expected old file to not exist, but got %v", err)
+		}
+		if data, err := readOverlayFile(o, "File 2"); err != nil || string(data) != "File 1" {
+			t.Errorf("Expected renamed file to have old content, but got %q, %v", data, err)
+		}
+		md := o.GetMetadata([]string{"File 2"})[0]
+		if md == nil || md.Name != "File 2" || md.LocalName != "674fe711_File_2" {
+			t.Errorf("Unexpected metadata for renamed file: %v", md)
+		}
+		if files := localFiles(t, root); !reflect.DeepEqual(files, []string{"674fe711_File_2"}) {
+			t.Errorf("Expected only renamed local file to stay, but got %v", files)
+		}
+	})
+
+	t.Run("Rename replaces existing file", func(t *testing.T) {
+		o, root := newOverlay(t, "File 1", "File 2")
+		if err := o.Rename("File 1", "File 2"); err != nil {
+			t.Errorf("Cannot rename file: %s", err)
+		}
+		if data, err := readOverlayFile(o, "File 2"); err != nil || string(data) != "File 1" {
+			t.Errorf("Expected replaced file to have new content, but got %q, %v", data, err)
+		}
+		if list := o.List(""); len(list) != 1 {
+			t.Errorf("Expected single file after rename, but got %v", list)
+		}
+		if files := localFiles(t, root); len(files) != 1 {
+			t.Errorf("Expected single local file after rename, but got %v", files)
+		}
+	})
+
+	t.Run("Rename non-existing file", func(t *testing.T) {
+		o, _ := newOverlay(t, "File 1")
+		if err := o.Rename("File 2", "File 3"); !os.IsNotExist(err) {
+			t.Errorf("Expected os.ErrNotExist, but got %v", err)
+		}
+	})
+
+	t.Run("List with prefix", func(t *testing.T) {
+		o, _ := newOverlay(t, "b/2", "a/1", "b/1", "c")
+		names := []string{}
+		for _, md := range o.List("b/") {
+			names = append(names, md.Name)
+		}
+		if !reflect.DeepEqual(names, []string{"b/1", "b/2"}) {
+			t.Errorf("Expected sorted files with prefix, but got %v", names)
+		}
+		if all := o.List(""); len(all) != 4 {
+			t.Errorf("Expected empty prefix to list all files, but got %v", all)
+		}
+	})
+
+	t.Run("Walk stops on error", func(t *testing.T) {
+		o, _ := newOverlay(t, "a", "b", "c")
+		visited := []string{}
+		err := Walk(o, "", func(md *FileMetadata) error {
+			visited = append(visited, md.Name)
+			if md.Name == "b" {
+				return fs.SkipAll
+			}
+			return nil
+		})
+		if err != nil || !reflect.DeepEqual(visited, []string{"a", "b"}) {
+			t.Errorf("Expected to visit [a b] without error, but got %v, %v", visited, err)
+		}
+	})
+}
+
+// failingStore fails to save the metadata while err is set.
+type failingStore struct {
+	MetadataStore
+
+	err error
+}
+
+func (fs *failingStore) Save(md *OverlayMetadata, changes []MetadataChange) error {
+	if fs.err != nil {
+		return fs.err
+	}
+	return fs.MetadataStore.Save(md, changes)
+}
+
+// withFailingStore wraps the configured metadata store with the failing one.
+func withFailingStore(store *failingStore) LocalOverlayOption {
+	return func(lo *localOverlay) {
+		store.MetadataStore = lo.store
+		lo.store = store
+	}
+}
+
+// crashingStore copies the root when the metadata is saved next time, leaving it like a crash
+// right before or right after the save would do.
+type crashingStore struct {
+	MetadataStore
+
+	root      string
+	snapshot  string
+	afterSave bool
+}
+
+func (cs *crashingStore) Save(md *OverlayMetadata, changes []MetadataChange) error {
+	snapshot := cs.snapshot
+	cs.snapshot = ""
+	if snapshot != "" && !cs.afterSave {
+		if err := copyDir(cs.root, snapshot); err != nil {
+			return err
+		}
+	}
+	if err := cs.MetadataStore.Save(md, changes); err != nil {
+		return err
+	}
+	if snapshot != "" && cs.afterSave {
+		return copyDir(cs.root, snapshot)
+	}
+	return nil
+}
+
+func withCrashingStore(store *crashingStore) LocalOverlayOption {
+	return func(lo *localOverlay) {
+		store.MetadataStore = lo.store
+		store.root = lo.root
+		lo.store = store
+	}
+}
+
+func copyDir(src string, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, must(filepath.Rel(src, path)))
+		if d.IsDir() {
+			return os.MkdirAll(target, defaultDirPermissions)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(target, data, defaultPermissions)
+	})
+}
+
+func TestOverlayCrashSafety(t *testing.T) {
+
+	for _, tc := range []struct {
+		name    string
+		options []LocalOverlayOption
+	}{
+		{name: "Local overlay"},
+		{name: "Content addressed overlay", options: []LocalOverlayOption{WithContentAddressing()}},
+		{name: "Versioned overlay", options: []LocalOverlayOption{WithVersioning(VersionLimits{})}},
+	} {
+		t.Run(tc.name+" rolls back the write when metadata is not saved", func(t *testing.T) {
+			store := &failingStore{}
+			o := newTestOverlay(t, "", append(tc.options, withFailingStore(store))...)
+			root := o.root
+			writeOverlayFile(o, "File 1", []byte("old content"))
+			before := allLocalFiles(t, root)
+
+			store.err = os.ErrPermission
+			for _, name := range []string{"File 1", "File 2"} {
+				if err := writeOverlayFile(o, name, []byte("new content")); err != os.ErrPermission {
+					t.Errorf("Expected %s close to fail, but got %v", name, err)
+				}
+			}
+			store.err = nil
+
+			if data, err := readOverlayFile(o, "File 1"); err != nil || string(data) != "old content" {
+				t.Errorf("Expected old content, but got %q, %v", data, err)
+			}
+			if names := listNames(o); !reflect.DeepEqual(names, []string{"File 1"}) {
+				t.Errorf("Expected failed write not to be listed, but got %v", names)
+			}
+			if after := allLocalFiles(t, root); !reflect.DeepEqual(before, after) {
+				t.Errorf("Expected local files %v, but got %v", before, after)
+			}
+			if entries, _ := os.ReadDir(filepath.Join(root, systemFolderName, tempFolderName)); len(entries) != 0 {
+				t.Errorf("Expected no temporary files, but got %v", entries)
+			}
+			if report := must(Verify(o, VerifyOptions{})); !report.IsClean() {
+				t.Errorf("Expected overlay to stay consistent, but got %v", report)
+			}
+		})
+	}
+
+	for _, tc := range []struct {
+		name    string
+		options []LocalOverlayOption
+	}{
+		{name: "Local overlay"},
+		{name: "Content addressed overlay", options: []LocalOverlayOption{WithContentAddressing()}},
+	} {
+		t.Run(tc.name+" rolls back the rename over another file", func(t *testing.T) {
+			store := &failingStore{}
+			o := newTestOverlay(t, "", append(tc.options, withFailingStore(store))...)
+			root := o.root
+			writeOverlayFile(o, "File 1", []byte("File 1"))
+			writeOverlayFile(o, "File 2", []byte("File 2"))
+			before := allLocalFiles(t, root)
+
+			store.err = os.ErrPermission
+			if err := o.Rename("File 1", "File 2"); err != os.ErrPermission {
+				t.Errorf("Expected rename to fail, but got %v", err)
+			}
+			store.err = nil
+
+			for _, name := range []string{"File 1", "File 2"} {
+				if data, err := readOverlayFile(o, name); err != nil || string(data) != name {
+					t.Errorf("Expected %s to keep its content, but got %q, %v", name, data, err)
+				}
+			}
+			if after := allLocalFiles(t, root); !reflect.DeepEqual(before, after) {
+				t.Errorf("Expected local files %v, but got %v", before, after)
+			}
+			if entries, _ := os.ReadDir(filepath.Join(root, systemFolderName, tempFolderName)); len(entries) != 0 {
+				t.Errorf("Expected no temporary files, but got %v", entries)
+			}
+		})
+	}
+
+	for _, tc := range []struct {
+		name    string
+		options []LocalOverlayOption
+	}{
+		{name: "Local overlay"},
+		{name: "Content addressed overlay", options: []LocalOverlayOption{WithContentAddressing()}},
+		{name: "Versioned overlay", options: []LocalOverlayOption{WithVersioning(VersionLimits{})}},
+	} {
+		for _, op := range []struct {
+			name   string
+			change func(o Overlay) error
+			after  map[string]string
+		}{
+			{
+				name:   "overwrite",
+				change: func(o Overlay) error { return writeOverlayFile(o, "File 1", []byte("new content")) },
+				after:  map[string]string{"File 1": "new content", "File 2": "File 2"},
+			},
+			{
+				name:   "rename",
+				change: func(o Overlay) error { return o.Rename("File 1", "File 2") },
+				after:  map[string]string{"File 2": "File 1"},
+			},
+		} {
+			for _, afterSave := range []bool{false, true} {
+				expected := map[string]string{"File 1": "File 1", "File 2": "File 2"}
+				name := fmt.Sprintf("%s recovers from a crash before the %s is saved", tc.name, op.name)
+				if afterSave {
+					expected = op.after
+					name = fmt.Sprintf("%s recovers from a crash after the %s is saved", tc.name, op.name)
+				}
+				t.Run(name, func(t *testing.T) {
+					store := &crashingStore{afterSave: afterSave}
+					o := newTestOverlay(t, "", append(tc.options, withCrashingStore(store))...)
+					writeOverlayFile(o, "File 1", []byte("File 1"))
+					writeOverlayFile(o, "File 2", []byte("File 2"))
+
+					store.snapshot = filepath.Join(t.TempDir(), "overlay_root")
+					root := store.snapshot
+					if err := op.change(o); err != nil {
+						t.Fatalf("Cannot %s: %v", op.name, err)
+					}
+
+					reopened := newTestOverlay(t, root, tc.options...)
+					result := map[string]string{}
+					for _, md := range reopened.List("") {
+						data, err := readOverlayFile(reopened, md.Name)
+						if err != nil {
+							t.Errorf("Cannot read %s: %v", md.Name, err)
+						}
+						result[md.Name] = string(data)
+					}
+					if !reflect.DeepEqual(result, expected) {
+						t.Errorf("Expected files %v, but got %v", expected, result)
+					}
+					if entries, _ := os.ReadDir(filepath.Join(root, systemFolderName, journalFolderName)); len(entries) != 0 {
+						t.Errorf("Expected journal to be removed, but got %v", entries)
+					}
+					must(GC(reopened, GCOptions{}))
+					if report := must(Verify(reopened, VerifyOptions{})); !report.IsClean() {
+						t.Errorf("Expected overlay to stay consistent, but got %v", report)
+					}
+				})
+			}
+		}
+	}
+
+	t.Run("Overwrite of missing local file", func(t *testing.T) {
+		o := newTestOverlay(t, "", WithVersioning(VersionLimits{}))
+		writeOverlayFile(o, "File 1", []byte("old content"))
+		os.Remove(filepath.Join(o.root, o.GetMetadata([]string{"File 1"})[0].LocalName))
+
+		if err := writeOverlayFile(o, "File 1", []byte("new content")); err != nil {
+			t.Errorf("Cannot overwrite file: %v", err)
+		}
+		if data, err := readOverlayFile(o, "File 1"); err != nil || string(data) != "new content" {
+			t.Errorf("Expected new content, but got %q, %v", data, err)
+		}
+	})
+
+	t.Run("Unfinished write is not visible", func(t *testing.T) {
+		root := filepath.Join(t.TempDir(), "overlay_root")
+		o, _ := NewLocalOverlay(root, NewJsonMarshal[OverlayMetadata]())
+		writeOverlayFile(o, "File 1", []byte("old content"))
+
+		wc, err := o.OpenWrite("File 1")
+		if err != nil {
+			t.Fatalf("Cannot open file for writing: %s", err)
+		}
+		wc.Write([]byte("new content"))
+
+		if data, err := readOverlayFile(o, "File 1"); err != nil || string(data) != "old content" {
+			t.Errorf("Expected to read old content before close, but got %q, %v", data, err)
+		}
+		wc.Close()
+		if data, err := readOverlayFile(o, "File 1"); err != nil || string(data) != "new content" {
+			t.Errorf("Expected to read new content after close, but got %q, %v", data, err)
+		}
+	})
+
+	t.Run("Leftovers removed on start", func(t *testing.T) {
+		root := filepath.Join(t.TempDir(), "overlay_root")
+		o, _ := NewLocalOverlay(root, NewJsonMarshal[OverlayMetadata]())
+		wc, _ := o.OpenWrite("File 1")
+		wc.Write([]byte("Never closed"))
+
+		if _, err := NewLocalOverlay(root, NewJsonMarshal[OverlayMetadata]()); err != nil {
+			t.Fatalf("Cannot reopen overlay: %s", err)
+		}
+		if entries, _ := os.ReadDir(filepath.Join(root, systemFolderName, tempFolderName)); len(entries) != 0 {
+			t.Errorf("Expected no temporary files, but got %v", entries)
+		}
+		if files := localFiles(t, root); len(files) != 0 {
+			t.Errorf("Expected no local files, but got %v", files)
+		}
+	})
+
+	t.Run("Restore torn metadata", func(t *testing.T) {
+		root := filepath.Join(t.TempDir(), "overlay_root")
+		o, _ := NewLocalOverlay(root, NewJsonMarshal[OverlayMetadata]())
+		writeOverlayFile(o, "File 1", []byte("File 1"))
+		writeOverlayFile(o, "File 2", []byte("File 2"))
+
+		metadataFile := filepath.Join(root, systemFolderName, metadataFileName)
+		os.WriteFile(metadataFile, []byte(`{"fileMetadata": {"Fi`), defaultPermissions)
+
+		reopened, err := NewLocalOverlay(root, NewJsonMarshal[OverlayMetadata]())
+		if err != nil {
+			t.Fatalf("Cannot reopen overlay: %s", err)
+		}
+		if data, err := readOverlayFile(reopened, "File 1"); err != nil || string(data) != "File 1" {
+			t.Errorf("Expected to restore previous metadata version, but got %q, %v", data, err)
+		}
+	})
+}
+
+func TestContentAddressedOverlay(t *testing.T) {
+
+	newOverlay := func(t *testing.T) (Overlay, string) {
+		root := filepath.Join(t.TempDir(), "overlay_root")
+		o, err := NewContentAddressedOverlay(root, NewJsonMarshal[OverlayMetadata]())
+		if err != nil {
+			t.Fatalf("Error while starting an overlay: %v", err)
+		}
+		return o, root
+	}
+	blob123 := "039058c6f2c0cb492c533b0a4d14ef77cc0f78abccced5287d84a1a2011cfb81"
+	blob456 := "787c798e39a5bc1910355bae6d0cd87a36b2e10fd0202a83e3bb6b005da83472"
+
+	t.Run("Same content shares local file", func(t *testing.T) {
+		o, root := newOverlay(t)
+		writeOverlayFile(o, "File 1", []byte{1, 2, 3})
+		writeOverlayFile(o, "File 2", []byte{1, 2, 3})
+
+		if files := localFiles(t, root); !reflect.DeepEqual(files, []string{blob123}) {
+			t.Errorf("Expected single local file, but got %v", files)
+		}
+		for _, md := range o.GetMetadata([]string{"File 1", "File 2"}) {
+			if md.LocalName != blob123 {
+				t.Errorf("Expected %s to reference blob %s, but got %s", md.Name, blob123, md.LocalName)
+			}
+		}
+	})
+
+	t.Run("Blob removed with the last reference", func(t *testing.T) {
+		o, root := newOverlay(t)
+		writeOverlayFile(o, "File 1", []byte{1, 2, 3})
+		writeOverlayFile(o, "File 2", []byte{1, 2, 3})
+
+		o.Delete("File 1")
+		if data, err := readOverlayFile(o, "File 2"); err != nil || !reflect.DeepEqual(data, []byte{1, 2, 3}) {
+			t.Errorf("Expected shared blob to stay readable, but got %v, %v", data, err)
+		}
+		o.Delete("File 2")
+		if files := localFiles(t, root); len(files) != 0 {
+			t.Errorf("Expected no local files, but got %v", files)
+		}
+	})
+
+	t.Run("Overwrite releases previous blob", func(t *testing.T) {
+		o, root := newOverlay(t)
+		writeOverlayFile(o, "File 1", []byte{1, 2, 3})
+		writeOverlayFile(o, "File 1", []byte{4, 5, 6})
+
+		if files := localFiles(t, root); !reflect.DeepEqual(files, []string{blob456}) {
+			t.Errorf("Expected only the new blob, but got %v", files)
+		}
+	})
+
+	t.Run("Rename keeps blob", func(t *testing.T) {
+		o, root := newOverlay(t)
+		writeOverlayFile(o, "File 1", []byte{1, 2, 3})
+		writeOverlayFile(o, "File 2", []byte{4, 5, 6})
+		o.Rename("File 1", "File 2")
+
+		if data, err := readOverlayFile(o, "File 2"); err != nil || !reflect.DeepEqual(data, []byte{1, 2, 3}) {
+			t.Errorf("Expected renamed file content, but got %v, %v", data, err)
+		}
+		if files := localFiles(t, root); !reflect.DeepEqual(files, []string{blob123}) {
+			t.Errorf("Expected replaced blob to be removed, but got %v", files)
+		}
+	})
+
+	t.Run("Reference counts restored on start", func(t *testing.T) {
+		o, root := newOverlay(t)
+		writeOverlayFile(o, "File 1", []byte{1, 2, 3})
+		writeOverlayFile(o, "File 2", []byte{1, 2, 3})
+
+		reopened, _ := NewContentAddressedOverlay(root, NewJsonMarshal[OverlayMetadata]())
+		reopened.Delete("File 1")
+		if files := localFiles(t, root); !reflect.DeepEqual(files, []string{blob123}) {
+			t.Errorf("Expected blob to be kept for remaining reference, but got %v", files)
+		}
+	})
+}
+
+func TestOverlayFileMetadata(t *testing.T) {
+
+	newOverlay := func(t *testing.T) (Overlay, string, *fakeClock) {
+		clock := newFakeClock()
+		o := newTestOverlay(t, "", withClock(clock))
+		return o, o.root, clock
+	}
+
+	t.Run("Timestamps", func(t *testing.T) {
+		o, _, clock := newOverlay(t)
+		created := clock.Now()
+		writeOverlayFile(o, "File 1", []byte{1, 2, 3})
+		clock.Advance(time.Hour)
+		modified := clock.Now()
+		writeOverlayFile(o, "File 1", []byte{4, 5, 6, 7})
+		clock.Advance(time.Hour)
+		accessed := clock.Now()
+		readOverlayFile(o, "File 1")
+
+		md := o.GetMetadata([]string{"File 1"})[0]
+		if !md.Created.Equal(created) || !md.Modified.Equal(modified) || !md.Accessed.Equal(accessed) {
+			t.Errorf("Expected created %s, modified %s, accessed %s, but got %s, %s, %s",
+				created, modified, accessed, md.Created, md.Modified, md.Accessed)
+		}
+		if md.Size != 4 {
+			t.Errorf("Expected size to be 4, but got %d", md.Size)
+		}
+	})
+
+	t.Run("Attributes set on write", func(t *testing.T) {
+		o, root, _ := newOverlay(t)
+		wc, _ := o.OpenWrite("File 1", WithAttributes(map[string]string{
+			"etag":   "\"abc\"",
+			"source": "http://someurl.domain/file",
+		}))
+		wc.Write([]byte{1, 2, 3})
+		wc.Close()
+
+		reopened, _ := NewLocalOverlay(root, NewJsonMarshal[OverlayMetadata]())
+		want := map[string]string{"etag": "\"abc\"", "source": "http://someurl.domain/file"}
+		if md := reopened.GetMetadata([]string{"File 1"})[0]; !reflect.DeepEqual(md.Attributes, want) {
+			t.Errorf("Expected attributes %v, but got %v", want, md.Attributes)
+		}
+	})
+
+	t.Run("Attributes replaced on overwrite", func(t *testing.T) {
+		o, _, _ := newOverlay(t)
+		wc, _ := o.OpenWrite("File 1", WithAttributes(map[string]string{"etag": "1", "source": "url"}))
+		wc.Close()
+		wc, _ = o.OpenWrite("File 1", WithAttributes(map[string]string{"etag": "2"}))
+		wc.Close()
+
+		want := map[string]string{"etag": "2"}
+		if md := o.GetMetadata([]string{"File 1"})[0]; !reflect.DeepEqual(md.Attributes, want) {
+			t.Errorf("Expected attributes %v, but got %v", want, md.Attributes)
+		}
+		wc, _ = o.OpenWrite("File 1")
+		wc.Close()
+		if md := o.GetMetadata([]string{"File 1"})[0]; md.Attributes != nil {
+			t.Errorf("Expected no attributes, but got %v", md.Attributes)
+		}
+	})
+
+	t.Run("Attributes merged on request", func(t *testing.T) {
+		o, _, _ := newOverlay(t)
+		wc, _ := o.OpenWrite("File 1", WithAttributes(map[string]string{"etag": "1", "source": "url"}))
+		wc.Close()
+		wc, _ = o.OpenWrite("File 1", WithAttributes(map[string]string{"etag": "2", "source": ""}), WithMergedAttributes())
+		wc.Close()
+		wc, _ = o.OpenAppend("File 1", WithAttributes(map[string]string{"language": "en"}))
+		wc.Close()
+
+		want := map[string]string{"etag": "2", "language": "en"}
+		if md := o.GetMetadata([]string{"File 1"})[0]; !reflect.DeepEqual(md.Attributes, want) {
+			t.Errorf("Expected attributes %v, but got %v", want, md.Attributes)
+		}
+	})
+
+	t.Run("SetAttributes updates and removes", func(t *testing.T) {
+		o, root, _ := newOverlay(t)
+		wc, _ := o.OpenWrite("File 1", WithAttributes(map[string]string{"etag": "1", "language": "en"}))
+		wc.Close()
+
+		if err := o.SetAttributes("File 1", map[string]string{"etag": "2", "language": ""}); err != nil {
+			t.Errorf("Cannot set attributes: %s", err)
+		}
+		reopened, _ := NewLocalOverlay(root, NewJsonMarshal[OverlayMetadata]())
+		want := map[string]string{"etag": "2"}
+		if md := reopened.GetMetadata([]string{"File 1"})[0]; !reflect.DeepEqual(md.Attributes, want) {
+			t.Errorf("Expected attributes %v, but got %v", want, md.Attributes)
+		}
+	})
+
+	t.Run("SetAttributes for non-existing file", func(t *testing.T) {
+		o, _, _ := newOverlay(t)
+		if err := o.SetAttributes("File 1", map[string]string{"etag": "1"}); !os.IsNotExist(err) {
+			t.Errorf("Expected os.ErrNotExist, but got %v", err)
+		}
+	})
+}
+
+func TestOverlaySeekable(t *testing.T) {
+	local, _ := NewLocalOverlay(filepath.Join(t.TempDir(), "overlay_root"), NewJsonMarshal[OverlayMetadata]())
+	for name, o := range map[string]Overlay{"Local overlay": local, "Memory overlay": NewMemoryOverlay()} {
+		t.Run(name, func(t *testing.T) {
+			writeOverlayFile(o, "File 1", []byte("0123456789"))
+
+			r, err := o.OpenSeekable("File 1")
+			if err != nil {
+				t.Fatalf("Cannot open file: %s", err)
+			}
+			defer r.Close()
+
+			if r.Size() != 10 {
+				t.Errorf("Expected size 10, but got %d", r.Size())
+			}
+			buf := make([]byte, 3)
+			if n, err := r.ReadAt(buf, 4); err != nil || string(buf[:n]) != "456" {
+				t.Errorf("Expected ReadAt to return 456, but got %q, %v", buf[:n], err)
+			}
+			if pos, err := r.Seek(-2, io.SeekEnd); err != nil || pos != 8 {
+				t.Errorf("Expected to seek to 8, but got %d, %v", pos, err)
+			}
+			if rest, err := io.ReadAll(r); err != nil || string(rest) != "89" {
+				t.Errorf("Expected to read 89 after seek, but got %q, %v", rest, err)
+			}
+			if _, err := o.OpenSeekable("File 2"); !os.IsNotExist(err) {
+				t.Errorf("Expected os.ErrNotExist, but got %v", err)
+			}
+		})
+	}
+}
+
+func TestOverlayAppend(t *testing.T) {
+	full := []byte("Hello resumable world")
+
+	appendFile := func(o Overlay, content []byte) error {
+		wc, err := o.OpenAppend("File 1")
+		if err != nil {
+			return err
+		}
+		if _, err := wc.Write(content); err != nil {
+			return err
+		}
+		return wc.Close()
+	}
+
+	root := filepath.Join(t.TempDir(), "overlay_root")
+	local, _ := NewLocalOverlay(root, NewJsonMarshal[OverlayMetadata]())
+	for name, o := range map[string]Overlay{"Local overlay": local, "Memory overlay": NewMemoryOverlay()} {
+		t.Run(name, func(t *testing.T) {
+			if err := appendFile(o, full[:5]); err != nil {
+				t.Fatalf("Cannot append to a new file: %s", err)
+			}
+			md := o.GetMetadata([]string{"File 1"})[0]
+			if !md.Incomplete || md.Size != 5 {
+				t.Errorf("Expected incomplete file of size 5, but got %v", md)
+			}
+
+			if err := appendFile(o, full[5:]); err != nil {
+				t.Fatalf("Cannot append to existing file: %s", err)
+			}
+			if data, err := readOverlayFile(o, "File 1"); err != nil || !bytes.Equal(data, full) {
+				t.Errorf("Expected appended content %q, but got %q, %v", full, data, err)
+			}
+			md = o.GetMetadata([]string{"File 1"})[0]
+			if !md.Incomplete || md.Size != int64(len(full)) || md.Sha256 != fmt.Sprintf("%x", sha256.Sum256(full)) {
+				t.Errorf("Expected sha256 and size of the whole content, but got %v", md)
+			}
+
+			if err := o.Finalize("File 1"); err != nil {
+				t.Errorf("Cannot finalize file: %s", err)
+			}
+			if md := o.GetMetadata([]string{"File 1"})[0]; md.Incomplete {
+				t.Errorf("Expected file to be complete after finalization, but got %v", md)
+			}
+			if err := o.Finalize("File 2"); !os.IsNotExist(err) {
+				t.Errorf("Expected os.ErrNotExist, but got %v", err)
+			}
+		})
+	}
+
+	t.Run("Incomplete state persisted", func(t *testing.T) {
+		root := filepath.Join(t.TempDir(), "overlay_root")
+		o, _ := NewLocalOverlay(root, NewJsonMarshal[OverlayMetadata]())
+		appendFile(o, full[:5])
+
+		reopened, _ := NewLocalOverlay(root, NewJsonMarshal[OverlayMetadata]())
+		if md := reopened.GetMetadata([]string{"File 1"})[0]; !md.Incomplete {
+			t.Errorf("Expected file to stay incomplete after reopening, but got %v", md)
+		}
+		appendFile(reopened, full[5:])
+		if data, err := readOverlayFile(reopened, "File 1"); err != nil || !bytes.Equal(data, full) {
+			t.Errorf("Expected resumed content %q, but got %q, %v", full, data, err)
+		}
+	})
+}
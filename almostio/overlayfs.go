@@ -0,0 +1,215 @@
+package almostio
+
+import (
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// overlayFS exposes the overlay as a read-only file system.
+type overlayFS struct {
+	fs.StatFS
+	fs.ReadDirFS
+
+	overlay Overlay
+}
+
+// NewOverlayFS exposes the overlay as a read-only fs.FS, which also implements fs.StatFS and
+// fs.ReadDirFS. File names are used as paths and folders are made of the "/" separated name
+// prefixes. Files with names that are not valid paths (see fs.ValidPath) are not accessible.
+func NewOverlayFS(o Overlay) fs.FS {
+	return &overlayFS{
+		overlay: o,
+	}
+}
+
+func (ofs *overlayFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if md := ofs.overlay.GetMetadata([]string{name})[0]; md != nil && name != "." {
+		r, err := ofs.overlay.OpenSeekable(name)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &overlayFile{SeekableReader: r, info: &fileInfo{md}}, nil
+	}
+	entries, err := ofs.readDir(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &overlayDir{info: &dirInfo{name: path.Base(name)}, entries: entries}, nil
+}
+
+func (ofs *overlayFS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	if md := ofs.overlay.GetMetadata([]string{name})[0]; md != nil && name != "." {
+		return &fileInfo{md}, nil
+	}
+	if _, err := ofs.readDir(name); err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return &dirInfo{name: path.Base(name)}, nil
+}
+
+func (ofs *overlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	entries, err := ofs.readDir(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return entries, nil
+}
+
+// readDir lists the files and folders directly under the folder, sorted by name. A folder exists
+// only if there are files in it, except the root folder, which always exists.
+func (ofs *overlayFS) readDir(name string) ([]fs.DirEntry, error) {
+	prefix := name + "/"
+	if name == "." {
+		prefix = ""
+	}
+
+	entries := map[string]fs.DirEntry{}
+	for _, md := range ofs.overlay.List(prefix) {
+		if !fs.ValidPath(md.Name) {
+			continue
+		}
+		child, _, isDir := strings.Cut(strings.TrimPrefix(md.Name, prefix), "/")
+		if _, ok := entries[child]; ok {
+			continue
+		}
+		if isDir {
+			entries[child] = fs.FileInfoToDirEntry(&dirInfo{name: child})
+		} else {
+			entries[child] = fs.FileInfoToDirEntry(&fileInfo{md})
+		}
+	}
+	if len(entries) == 0 && name != "." {
+		return nil, fs.ErrNotExist
+	}
+
+	result := []fs.DirEntry{}
+	for _, entry := range entries {
+		result = append(result, entry)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name() < result[j].Name()
+	})
+	return result, nil
+}
+
+// fileInfo describes a file using its metadata, which is returned by Sys().
+type fileInfo struct {
+	md *FileMetadata
+}
+
+func (fi *fileInfo) Name() string       { return path.Base(fi.md.Name) }
+func (fi *fileInfo) Size() int64        { return fi.md.Size }
+func (fi *fileInfo) Mode() fs.FileMode  { return 0444 }
+func (fi *fileInfo) ModTime() time.Time { return fi.md.Modified }
+func (fi *fileInfo) IsDir() bool        { return false }
+func (fi *fileInfo) Sys() any           { return fi.md }
+
+type dirInfo struct {
+	name string
+}
+
+func (di *dirInfo) Name() string       { return di.name }
+func (di *dirInfo) Size() int64        { return 0 }
+func (di *dirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0555 }
+func (di *dirInfo) ModTime() time.Time { return time.Time{} }
+func (di *dirInfo) IsDir() bool        { return true }
+func (di *dirInfo) Sys() any           { return nil }
+
+type overlayFile struct {
+	SeekableReader
+
+	info fs.FileInfo
+}
+
+func (of *overlayFile) Stat() (fs.FileInfo, error) {
+	return of.info, nil
+}
+
+type overlayDir struct {
+	fs.ReadDirFile
+
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (od *overlayDir) Stat() (fs.FileInfo, error) {
+	return od.info, nil
+}
+
+func (od *overlayDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: od.info.Name(), Err: fs.ErrInvalid}
+}
+
+func (od *overlayDir) Close() error {
+	return nil
+}
+
+func (od *overlayDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := od.entries[od.offset:]
+	if n <= 0 {
+		od.offset = len(od.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(rest))
+	od.offset += n
+	return rest[:n], nil
+}
+
+// overlayHandler serves files from the overlay over http.
+type overlayHandler struct {
+	http.Handler
+
+	overlay Overlay
+}
+
+// NewOverlayHandler serves overlay files using the request path without the leading slash as the
+// file name. Content type comes from the metadata, ETag is the sha256 of the content, range and
+// conditional requests are supported. Use http.StripPrefix to serve from a sub-path.
+func NewOverlayHandler(o Overlay) http.Handler {
+	return &overlayHandler{
+		overlay: o,
+	}
+}
+
+func (oh *overlayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	md := oh.overlay.GetMetadata([]string{name})[0]
+	if md == nil {
+		http.NotFound(w, r)
+		return
+	}
+	content, err := oh.overlay.OpenSeekable(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer content.Close()
+
+	w.Header().Set("Content-Type", md.Mime)
+	w.Header().Set("ETag", "\""+md.Sha256+"\"")
+	http.ServeContent(w, r, path.Base(name), md.Modified, content)
+}
@@ -0,0 +1,130 @@
+package almostio
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"testing/fstest"
+	"text/template"
+)
+
+func TestOverlayFS(t *testing.T) {
+
+	newFS := func(t *testing.T) fs.FS {
+		o, err := NewLocalOverlay(filepath.Join(t.TempDir(), "overlay_root"), NewJsonMarshal[OverlayMetadata]())
+		if err != nil {
+			t.Fatalf("Error while starting an overlay: %v", err)
+		}
+		for name, content := range map[string]string{
+			"index.html":              "<html>{{.}}</html>",
+			"templates/a.tmpl":        "A {{.}}",
+			"templates/nested/b.tmpl": "B {{.}}",
+			"http://invalid.path":     "Not accessible",
+		} {
+			writeOverlayFile(o, name, []byte(content))
+		}
+		return NewOverlayFS(o)
+	}
+
+	t.Run("Passes fstest", func(t *testing.T) {
+		if err := fstest.TestFS(newFS(t), "index.html", "templates/a.tmpl", "templates/nested/b.tmpl"); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("WalkDir", func(t *testing.T) {
+		visited := []string{}
+		fs.WalkDir(newFS(t), ".", func(path string, d fs.DirEntry, err error) error {
+			visited = append(visited, path)
+			return err
+		})
+		want := []string{".", "index.html", "templates", "templates/a.tmpl", "templates/nested", "templates/nested/b.tmpl"}
+		if !reflect.DeepEqual(visited, want) {
+			t.Errorf("Expected to visit %v, but got %v", want, visited)
+		}
+	})
+
+	t.Run("Stat uses metadata", func(t *testing.T) {
+		info, err := fs.Stat(newFS(t), "templates/a.tmpl")
+		if err != nil {
+			t.Fatalf("Cannot stat file: %s", err)
+		}
+		md, ok := info.Sys().(*FileMetadata)
+		if info.Name() != "a.tmpl" || info.Size() != 7 || !ok || md.Name != "templates/a.tmpl" {
+			t.Errorf("Unexpected file info %v", info)
+		}
+		if _, err := fs.Stat(newFS(t), "missing"); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Expected fs.ErrNotExist, but got %v", err)
+		}
+	})
+
+	t.Run("ParseFS", func(t *testing.T) {
+		tmpl, err := template.ParseFS(newFS(t), "templates/*.tmpl")
+		if err != nil {
+			t.Fatalf("Cannot parse templates: %s", err)
+		}
+		if tmpl.Lookup("a.tmpl") == nil {
+			t.Errorf("Expected template a.tmpl to be parsed")
+		}
+	})
+}
+
+func TestOverlayHandler(t *testing.T) {
+	o := NewMemoryOverlay()
+	writeOverlayFile(o, "files/hello.txt", []byte("Hello world"))
+	md := o.GetMetadata([]string{"files/hello.txt"})[0]
+	server := httptest.NewServer(NewOverlayHandler(o))
+	defer server.Close()
+
+	get := func(t *testing.T, path string, headers map[string]string) (*http.Response, string) {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %s", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	t.Run("Full content", func(t *testing.T) {
+		resp, body := get(t, "/files/hello.txt", nil)
+		if resp.StatusCode != http.StatusOK || body != "Hello world" {
+			t.Errorf("Expected 200 with content, but got %d %q", resp.StatusCode, body)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != md.Mime {
+			t.Errorf("Expected content type %s, but got %s", md.Mime, ct)
+		}
+		if etag := resp.Header.Get("ETag"); etag != "\""+md.Sha256+"\"" {
+			t.Errorf("Expected ETag from sha256, but got %s", etag)
+		}
+	})
+
+	t.Run("Range", func(t *testing.T) {
+		resp, body := get(t, "/files/hello.txt", map[string]string{"Range": "bytes=6-"})
+		if resp.StatusCode != http.StatusPartialContent || body != "world" {
+			t.Errorf("Expected 206 with partial content, but got %d %q", resp.StatusCode, body)
+		}
+	})
+
+	t.Run("Not modified", func(t *testing.T) {
+		resp, _ := get(t, "/files/hello.txt", map[string]string{"If-None-Match": "\"" + md.Sha256 + "\""})
+		if resp.StatusCode != http.StatusNotModified {
+			t.Errorf("Expected 304, but got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Not found", func(t *testing.T) {
+		if resp, _ := get(t, "/files/missing.txt", nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected 404, but got %d", resp.StatusCode)
+		}
+	})
+}
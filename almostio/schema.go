@@ -0,0 +1,63 @@
+package almostio
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrUnsupportedSchema is returned when the metadata was written by a newer version of the
+// package, saving it would drop the fields this version does not know about.
+var ErrUnsupportedSchema = errors.New("unsupported metadata schema version")
+
+// metadataUpgrade converts the metadata from the previous schema version in place.
+type metadataUpgrade func(md *OverlayMetadata) error
+
+// metadataUpgrades[i] upgrades the metadata from schema version i to i+1, so the number of the
+// upgrades is the current schema version. Upgrades are appended when the metadata format changes.
+var metadataUpgrades = []metadataUpgrade{
+	// Metadata without the schema version has the same format
+	func(md *OverlayMetadata) error {
+		return nil
+	},
+}
+
+// WithReadOnly opens the overlay without changing anything on disk: writes, deletes and other
+// changes fail with os.ErrPermission, access times are kept only in memory, metadata of older
+// schema versions is upgraded and interrupted metadata saves are recovered only in memory.
+func WithReadOnly() LocalOverlayOption {
+	return func(lo *localOverlay) {
+		lo.readOnly = true
+	}
+}
+
+// readOnlyStore is a metadata store that can load the metadata without changing anything on disk,
+// e.g. without recovering from interrupted saves. Other stores are used as they are.
+type readOnlyStore interface {
+	setReadOnly()
+}
+
+// upgrade converts the metadata to the current schema version, returns true if the metadata
+// changed and has to be saved.
+func (lo *localOverlay) upgrade(md *OverlayMetadata) (bool, error) {
+	current := len(lo.upgrades)
+	if md.SchemaVersion > current {
+		return false, fmt.Errorf("%w: %d, the newest known version is %d", ErrUnsupportedSchema, md.SchemaVersion, current)
+	}
+	upgraded := md.SchemaVersion < current
+	for md.SchemaVersion < current {
+		if err := lo.upgrades[md.SchemaVersion](md); err != nil {
+			return false, fmt.Errorf("cannot upgrade metadata from schema version %d: %w", md.SchemaVersion, err)
+		}
+		md.SchemaVersion++
+	}
+	return upgraded, nil
+}
+
+// checkWritable fails for the read-only overlays.
+func (lo *localOverlay) checkWritable() error {
+	if lo.readOnly {
+		return os.ErrPermission
+	}
+	return nil
+}
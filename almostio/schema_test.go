@@ -0,0 +1,285 @@
+package almostio
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func withUpgrades(upgrades ...metadataUpgrade) LocalOverlayOption {
+	return func(lo *localOverlay) {
+		lo.upgrades = upgrades
+	}
+}
+
+// newLegacyOverlay creates an overlay with a single file and metadata of the given schema version,
+// returns the root and the saved metadata file.
+func newLegacyOverlay(t *testing.T, schemaVersion int) (string, []byte) {
+	o := newTestOverlay(t, "")
+	root := o.root
+	writeOverlayFile(o, "File 1", []byte("File 1"))
+
+	md := &OverlayMetadata{
+		SchemaVersion: schemaVersion,
+		FileMetadata:  map[string]*FileMetadata{"File 1": o.GetMetadata([]string{"File 1"})[0]},
+	}
+	if err := metadataStore(root).Save(md, nil); err != nil {
+		t.Fatalf("Cannot save metadata: %v", err)
+	}
+	return root, must(os.ReadFile(metadataFile(root)))
+}
+
+func metadataFile(root string) string {
+	return filepath.Join(root, systemFolderName, metadataFileName)
+}
+
+func metadataStore(root string) MetadataStore {
+	return NewSnapshotMetadataStore(metadataFile(root), NewJsonMarshal[OverlayMetadata]())
+}
+
+func TestMetadataSchema(t *testing.T) {
+
+	t.Run("New overlay has current version", func(t *testing.T) {
+		root := filepath.Join(t.TempDir(), "overlay_root")
+		NewLocalOverlay(root, NewJsonMarshal[OverlayMetadata]())
+
+		if md, err := metadataStore(root).Load(); err != nil || md.SchemaVersion != len(metadataUpgrades) {
+			t.Errorf("Expected schema version %d, but got %v, %v", len(metadataUpgrades), md, err)
+		}
+	})
+
+	t.Run("Metadata without version is upgraded", func(t *testing.T) {
+		root, _ := newLegacyOverlay(t, 0)
+
+		o, err := NewLocalOverlay(root, NewJsonMarshal[OverlayMetadata]())
+		if err != nil {
+			t.Fatalf("Cannot open legacy overlay: %v", err)
+		}
+		if data, err := readOverlayFile(o, "File 1"); err != nil || string(data) != "File 1" {
+			t.Errorf("Expected files to be readable, but got %q, %v", data, err)
+		}
+		if md, err := metadataStore(root).Load(); err != nil || md.SchemaVersion != len(metadataUpgrades) {
+			t.Errorf("Expected upgraded metadata to be saved, but got %v, %v", md, err)
+		}
+	})
+
+	t.Run("Upgrades run in order once", func(t *testing.T) {
+		root, _ := newLegacyOverlay(t, 1)
+		calls := []int{}
+		upgrades := withUpgrades(
+			func(md *OverlayMetadata) error {
+				calls = append(calls, 0)
+				return nil
+			},
+			func(md *OverlayMetadata) error {
+				calls = append(calls, 1)
+				for name, fmd := range md.FileMetadata {
+					upgraded := *fmd
+					upgraded.Attributes = map[string]string{"upgraded": "true"}
+					md.FileMetadata[name] = &upgraded
+				}
+				return nil
+			},
+			func(md *OverlayMetadata) error {
+				calls = append(calls, 2)
+				return nil
+			})
+
+		for range 2 {
+			if _, err := NewLocalOverlay(root, NewJsonMarshal[OverlayMetadata](), upgrades); err != nil {
+				t.Fatalf("Cannot open overlay: %v", err)
+			}
+		}
+		if !reflect.DeepEqual(calls, []int{1, 2}) {
+			t.Errorf("Expected upgrades from version 1 to run once, but got %v", calls)
+		}
+		md, err := metadataStore(root).Load()
+		if err != nil || md.SchemaVersion != 3 || md.FileMetadata["File 1"].Attributes["upgraded"] != "true" {
+			t.Errorf("Expected upgraded metadata, but got %v, %v", md, err)
+		}
+	})
+
+	t.Run("Failed upgrade", func(t *testing.T) {
+		root, want := newLegacyOverlay(t, 0)
+		failing := withUpgrades(func(md *OverlayMetadata) error {
+			return os.ErrInvalid
+		})
+
+		if _, err := NewLocalOverlay(root, NewJsonMarshal[OverlayMetadata](), failing); !errors.Is(err, os.ErrInvalid) {
+			t.Errorf("Expected upgrade error, but got %v", err)
+		}
+		if got := must(os.ReadFile(metadataFile(root))); string(got) != string(want) {
+			t.Errorf("Expected metadata %s not to change, but got %s", want, got)
+		}
+	})
+
+	t.Run("Newer version is refused", func(t *testing.T) {
+		root, want := newLegacyOverlay(t, len(metadataUpgrades)+1)
+
+		for _, options := range [][]LocalOverlayOption{{}, {WithReadOnly()}, {WithLogMetadataStore()}} {
+			if _, err := NewLocalOverlay(root, NewJsonMarshal[OverlayMetadata](), options...); !errors.Is(err, ErrUnsupportedSchema) {
+				t.Errorf("Expected unsupported schema error, but got %v", err)
+			}
+		}
+		if got := must(os.ReadFile(metadataFile(root))); string(got) != string(want) {
+			t.Errorf("Expected metadata %s not to change, but got %s", want, got)
+		}
+	})
+
+	t.Run("Log store keeps version", func(t *testing.T) {
+		root, _ := newLegacyOverlay(t, 0)
+		logged := func(options ...LocalOverlayOption) Overlay {
+			o, err := NewLocalOverlay(root, NewJsonMarshal[OverlayMetadata](), append(options, WithLogMetadataStore())...)
+			if err != nil {
+				t.Fatalf("Cannot open overlay: %v", err)
+			}
+			return o
+		}
+		logged()
+		writeOverlayFile(logged(), "File 2", []byte("File 2"))
+
+		store := NewLogMetadataStore(filepath.Join(root, systemFolderName, metadataLogFileName))
+		if md, err := store.Load(); err != nil || md.SchemaVersion != len(metadataUpgrades) || len(md.FileMetadata) != 2 {
+			t.Errorf("Expected upgraded log, but got %v, %v", md, err)
+		}
+
+		upgraded := false
+		logged(withUpgrades(
+			func(md *OverlayMetadata) error { return nil },
+			func(md *OverlayMetadata) error {
+				upgraded = true
+				return nil
+			}))
+		if md, err := store.Load(); err != nil || md.SchemaVersion != 2 || !upgraded {
+			t.Errorf("Expected log to be upgraded, but got %v, %v", md, err)
+		}
+	})
+}
+
+func TestReadOnlyOverlay(t *testing.T) {
+	root, before := newLegacyOverlay(t, 0)
+	leftover := filepath.Join(root, systemFolderName, tempFolderName, "write-other-process")
+	os.WriteFile(leftover, []byte("leftover"), defaultPermissions)
+
+	o, err := NewLocalOverlay(root, NewJsonMarshal[OverlayMetadata](), WithReadOnly())
+	if err != nil {
+		t.Fatalf("Cannot open read-only overlay: %v", err)
+	}
+	if data, err := readOverlayFile(o, "File 1"); err != nil || string(data) != "File 1" {
+		t.Errorf("Expected files to be readable, but got %q, %v", data, err)
+	}
+	if _, err := o.OpenWrite("File 2"); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("Expected write to fail, but got %v", err)
+	}
+	if _, err := o.OpenAppend("File 1"); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("Expected append to fail, but got %v", err)
+	}
+	if err := o.Delete("File 1"); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("Expected delete to fail, but got %v", err)
+	}
+	if err := o.Rename("File 1", "File 2"); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("Expected rename to fail, but got %v", err)
+	}
+	if err := o.SetAttributes("File 1", map[string]string{"etag": "1"}); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("Expected attributes update to fail, but got %v", err)
+	}
+	if _, err := GC(o, GCOptions{}); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("Expected garbage collection to fail, but got %v", err)
+	}
+	if report, err := Verify(o, VerifyOptions{}); err != nil || !report.IsClean() {
+		t.Errorf("Expected verification to work, but got %v, %v", report, err)
+	}
+
+	if names := listNames(o); !reflect.DeepEqual(names, []string{"File 1"}) {
+		t.Errorf("Expected files not to change, but got %v", names)
+	}
+	if after := must(os.ReadFile(metadataFile(root))); string(after) != string(before) {
+		t.Errorf("Expected metadata not to be saved, but got %s", after)
+	}
+	if _, err := os.Stat(leftover); err != nil {
+		t.Errorf("Expected temp files to be kept, but got %v", err)
+	}
+}
+
+// dirContents returns the content of all files under the root by their relative paths.
+func dirContents(t *testing.T, root string) map[string]string {
+	result := map[string]string{}
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		result[must(filepath.Rel(root, path))] = string(data)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Cannot read %s: %v", root, err)
+	}
+	return result
+}
+
+func TestReadOnlyOpen(t *testing.T) {
+	logFile := func(root string) string {
+		return filepath.Join(root, systemFolderName, metadataLogFileName)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		options []LocalOverlayOption
+		crash   func(root string)
+	}{
+		{
+			name:  "Interrupted snapshot save",
+			crash: func(root string) { os.Rename(metadataFile(root), metadataFile(root)+tempSuffix) },
+		},
+		{
+			name: "Corrupted snapshot",
+			crash: func(root string) {
+				os.Rename(metadataFile(root), metadataFile(root)+backupSuffix)
+				os.WriteFile(metadataFile(root), []byte("{"), defaultPermissions)
+			},
+		},
+		{
+			name:    "Log without snapshot",
+			options: []LocalOverlayOption{WithLogMetadataStore()},
+			crash:   func(root string) {},
+		},
+		{
+			name:    "Interrupted log compaction",
+			options: []LocalOverlayOption{WithLogMetadataStore()},
+			crash: func(root string) {
+				NewLocalOverlay(root, NewJsonMarshal[OverlayMetadata](), WithLogMetadataStore())
+				os.Rename(logFile(root), logFile(root)+backupSuffix)
+			},
+		},
+		{
+			name:    "Torn log record",
+			options: []LocalOverlayOption{WithLogMetadataStore()},
+			crash: func(root string) {
+				NewLocalOverlay(root, NewJsonMarshal[OverlayMetadata](), WithLogMetadataStore())
+				f := must(os.OpenFile(logFile(root), os.O_WRONLY|os.O_APPEND, defaultPermissions))
+				f.Write([]byte(`{"name":"File 2","meta`))
+				f.Close()
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root, _ := newLegacyOverlay(t, 0)
+			tc.crash(root)
+			before := dirContents(t, root)
+
+			o, err := NewLocalOverlay(root, NewJsonMarshal[OverlayMetadata](), append(tc.options, WithReadOnly())...)
+			if err != nil {
+				t.Fatalf("Cannot open read-only overlay: %v", err)
+			}
+			if data, err := readOverlayFile(o, "File 1"); err != nil || string(data) != "File 1" {
+				t.Errorf("Expected files to be readable, but got %q, %v", data, err)
+			}
+			if after := dirContents(t, root); !reflect.DeepEqual(after, before) {
+				t.Errorf("Expected files %v not to change, but got %v", before, after)
+			}
+		})
+	}
+}
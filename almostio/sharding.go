@@ -0,0 +1,132 @@
+package almostio
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	shardNameLength = 2
+	maxShardDepth   = 8
+)
+
+// WithSharding keeps local files in nested folders named after the hash prefix, e.g.
+// "8b/fb/8bfb0bf7_http_someurl.domain_" for depth 2. Helps when there are too many files for a
+// single folder. Depth is limited to 8 levels, zero means no sharding.
+func WithSharding(depth int) LocalOverlayOption {
+	return func(lo *localOverlay) {
+		lo.shardDepth = max(0, min(depth, maxShardDepth))
+	}
+}
+
+func isHex(s string) bool {
+	return strings.Trim(s, "0123456789abcdef") == ""
+}
+
+// shard prefixes the local name with the folders. The folders are taken from the local name
+// itself if it starts with a hash and from the sha256 of the local name otherwise.
+func (lo *localOverlay) shard(localName string) string {
+	if lo.shardDepth == 0 {
+		return localName
+	}
+	prefixLength := lo.shardDepth * shardNameLength
+	prefix := localName
+	if len(prefix) < prefixLength || !isHex(prefix[:prefixLength]) {
+		prefix = fmt.Sprintf("%x", sha256.Sum256([]byte(localName)))
+	}
+
+	parts := []string{}
+	for i := 0; i < prefixLength; i += shardNameLength {
+		parts = append(parts, prefix[i:i+shardNameLength])
+	}
+	return path.Join(append(parts, localName)...)
+}
+
+// migrate moves local files to match the current layout and removes folders left empty.
+func (lo *localOverlay) migrate() error {
+	lo.lock.Lock()
+	defer lo.lock.Unlock()
+
+	if err := lo.checkWritable(); err != nil {
+		return err
+	}
+	// Files moved before a failure are still saved to the metadata, so the migration can be resumed
+	var moveErr error
+	moved := map[string]string{}
+	names := []string{}
+	for name := range lo.metadata.FileMetadata {
+		names = append(names, name)
+	}
+	// Entries are updated one by one, so the naming strategy sees the local names already taken
+	sort.Strings(names)
+	for _, name := range names {
+		md := lo.metadata.FileMetadata[name]
+		newLocalName, ok := moved[md.LocalName]
+		if !ok {
+			newLocalName = lo.localName(name, md.Sha256, md.Codec)
+			if newLocalName != md.LocalName {
+				if moveErr = lo.moveLocal(lo.resolve(md.LocalName), newLocalName); moveErr != nil {
+					break
+				}
+			}
+			moved[md.LocalName] = newLocalName
+		}
+		if newLocalName != md.LocalName {
+			updated := *md
+			updated.LocalName = newLocalName
+			lo.setEntry(name, &updated)
+		}
+	}
+	if err := lo.writeMetadata(); err != nil {
+		return err
+	}
+	if moveErr != nil {
+		return moveErr
+	}
+	return lo.removeEmptyFolders()
+}
+
+func (lo *localOverlay) removeEmptyFolders() error {
+	folders := []string{}
+	err := filepath.WalkDir(lo.root, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() || p == lo.root {
+			return nil
+		}
+		if d.Name() == systemFolderName && filepath.Dir(p) == lo.root {
+			return filepath.SkipDir
+		}
+		folders = append(folders, p)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Deeper folders go first, so parents are empty when we reach them
+	sort.Sort(sort.Reverse(sort.StringSlice(folders)))
+	for _, folder := range folders {
+		if entries, err := os.ReadDir(folder); err == nil && len(entries) == 0 {
+			os.Remove(folder)
+		}
+	}
+	return nil
+}
+
+// MigrateLocalOverlay moves files of an existing overlay to the layout defined by the options,
+// e.g. converts a flat overlay into the sharded one or back.
+func MigrateLocalOverlay(root string, marshaller *Marshaller[OverlayMetadata], options ...LocalOverlayOption) error {
+	o, err := NewLocalOverlay(root, marshaller, options...)
+	if err != nil {
+		return err
+	}
+	lo := o.(*localOverlay)
+	defer lo.Close()
+	return lo.migrate()
+}
@@ -0,0 +1,118 @@
+package almostio
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func allLocalFiles(t *testing.T, root string) []string {
+	result := []string{}
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == systemFolderName {
+			return filepath.SkipDir
+		}
+		if !d.IsDir() {
+			rel, _ := filepath.Rel(root, path)
+			result = append(result, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Cannot list overlay root %s: %s", root, err)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func TestSharding(t *testing.T) {
+
+	for _, tc := range []struct {
+		name      string
+		options   []LocalOverlayOption
+		localName string
+	}{
+		{
+			name:      "No sharding",
+			options:   []LocalOverlayOption{WithSharding(0)},
+			localName: "644fe258_File_1",
+		},
+		{
+			name:      "Depth 2",
+			options:   []LocalOverlayOption{WithSharding(2)},
+			localName: "64/4f/644fe258_File_1",
+		},
+		{
+			name:      "Depth above name hash length",
+			options:   []LocalOverlayOption{WithSharding(5)},
+			localName: "96/dc/cf/bc/4d/644fe258_File_1",
+		},
+		{
+			name:      "Content addressed",
+			options:   []LocalOverlayOption{WithSharding(1), WithContentAddressing()},
+			localName: "03/039058c6f2c0cb492c533b0a4d14ef77cc0f78abccced5287d84a1a2011cfb81",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root := filepath.Join(t.TempDir(), "overlay_root")
+			o, err := NewLocalOverlay(root, NewJsonMarshal[OverlayMetadata](), tc.options...)
+			if err != nil {
+				t.Fatalf("Error while starting an overlay: %v", err)
+			}
+			writeOverlayFile(o, "File 1", []byte{1, 2, 3})
+
+			if md := o.GetMetadata([]string{"File 1"})[0]; md.LocalName != tc.localName {
+				t.Errorf("Expected local name %s, but got %s", tc.localName, md.LocalName)
+			}
+			if files := allLocalFiles(t, root); !reflect.DeepEqual(files, []string{tc.localName}) {
+				t.Errorf("Expected local files [%s], but got %v", tc.localName, files)
+			}
+			if data, err := readOverlayFile(o, "File 1"); err != nil || !reflect.DeepEqual(data, []byte{1, 2, 3}) {
+				t.Errorf("Expected to read written data, but got %v, %v", data, err)
+			}
+			if err := o.Rename("File 1", "File 2"); err != nil {
+				t.Errorf("Cannot rename sharded file: %s", err)
+			}
+			if report, err := Verify(o, VerifyOptions{}); err != nil || !report.IsClean() {
+				t.Errorf("Expected sharded overlay to be clean, but got %v, %v", report, err)
+			}
+		})
+	}
+
+	t.Run("Migrate flat to sharded and back", func(t *testing.T) {
+		root := filepath.Join(t.TempDir(), "overlay_root")
+		o, _ := NewLocalOverlay(root, NewJsonMarshal[OverlayMetadata]())
+		names := []string{"File 1", "File 2", "File 3"}
+		for _, name := range names {
+			writeOverlayFile(o, name, []byte(name))
+		}
+
+		if err := MigrateLocalOverlay(root, NewJsonMarshal[OverlayMetadata](), WithSharding(2)); err != nil {
+			t.Fatalf("Cannot migrate to sharded layout: %s", err)
+		}
+		sharded, _ := NewLocalOverlay(root, NewJsonMarshal[OverlayMetadata](), WithSharding(2))
+		for _, file := range allLocalFiles(t, root) {
+			if strings.Count(file, "/") != 2 {
+				t.Errorf("Expected file to be sharded, but got %s", file)
+			}
+		}
+		for _, name := range names {
+			if data, err := readOverlayFile(sharded, name); err != nil || string(data) != name {
+				t.Errorf("Expected to read %s after migration, but got %q, %v", name, data, err)
+			}
+		}
+
+		if err := MigrateLocalOverlay(root, NewJsonMarshal[OverlayMetadata]()); err != nil {
+			t.Fatalf("Cannot migrate to flat layout: %s", err)
+		}
+		if files := localFiles(t, root); len(files) != 3 {
+			t.Errorf("Expected 3 flat files without shard folders, but got %v", files)
+		}
+	})
+}
@@ -0,0 +1,181 @@
+package almostio
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+)
+
+const lockFileName = "lock"
+
+// WithSharedRoot lets several processes use the same root. Changes are serialized with an
+// advisory lock on ".overlay/lock", and the metadata saved by another process is loaded before
+// the next operation, watchers get EventOverflow then. All processes must open the root with
+// this option and the same metadata store. Temp files are not removed on start, because they
+// could belong to the writes of other processes, use GC with TempFileAge instead, it keeps the
+// temp files of the last day if TempFileAge is not set. Only supported on unix systems, opening
+// fails with errors.ErrUnsupported elsewhere. The overlay implements io.Closer, Close releases
+// the lock file.
+func WithSharedRoot() LocalOverlayOption {
+	return func(lo *localOverlay) {
+		lo.shared = true
+	}
+}
+
+// rootLock guards the overlay state. For shared roots, Lock also takes the lock file and RLock
+// loads the changes of other processes, so the state is current while the lock is held.
+type rootLock struct {
+	sync.RWMutex
+
+	// file keeps the number of metadata saves, nil if the root is not shared.
+	file *os.File
+	// generation is the number of saves seen by this process.
+	generation uint64
+	// reload replaces the state with the stored one.
+	reload func() error
+	// err is set when the changes of other processes could not be loaded, so saving is unsafe.
+	err error
+	// closed is set when the lock file was closed, the changes cannot be saved after that.
+	closed bool
+	// flush applies the changes recorded by the readers, called before the state is changed.
+	flush func()
+}
+
+func (rl *rootLock) Lock() {
+	rl.RWMutex.Lock()
+	if rl.flush != nil {
+		rl.flush()
+	}
+	if rl.file != nil {
+		rl.err = rl.sync(true)
+	}
+}
+
+func (rl *rootLock) Unlock() {
+	if rl.file != nil {
+		unlockFile(rl.file)
+	}
+	rl.RWMutex.Unlock()
+}
+
+func (rl *rootLock) RLock() {
+	if rl.file != nil {
+		// Readers share the state, so it is reloaded before they get it
+		rl.RWMutex.Lock()
+		if rl.flush != nil {
+			rl.flush()
+		}
+		rl.err = rl.sync(false)
+		unlockFile(rl.file)
+		rl.RWMutex.Unlock()
+	}
+	rl.RWMutex.RLock()
+}
+
+// sync takes the lock file and reloads the state if another process saved the metadata.
+func (rl *rootLock) sync(exclusive bool) error {
+	if rl.closed {
+		return os.ErrClosed
+	}
+	if err := lockFile(rl.file, exclusive); err != nil {
+		return err
+	}
+	generation, err := rl.saves()
+	if err != nil || generation == rl.generation {
+		return err
+	}
+	if err := rl.reload(); err != nil {
+		return err
+	}
+	rl.generation = generation
+	return nil
+}
+
+func (rl *rootLock) saves() (uint64, error) {
+	data := make([]byte, 8)
+	if _, err := rl.file.ReadAt(data, 0); err == io.EOF {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(data), nil
+}
+
+// changing tells other processes that the metadata is going to be saved, must be called with the
+// lock held before the save. A failed save only makes others reload the same metadata.
+func (rl *rootLock) changing() error {
+	if rl.file == nil {
+		return nil
+	}
+	if rl.err != nil {
+		return rl.err
+	}
+	data := binary.BigEndian.AppendUint64(nil, rl.generation+1)
+	if _, err := rl.file.WriteAt(data, 0); err != nil {
+		return err
+	}
+	rl.generation++
+	return nil
+}
+
+// openLockFile prepares the lock for the shared root, read-only overlays need the lock file to be
+// created by a writer.
+func (lo *localOverlay) openLockFile() error {
+	flag := os.O_RDONLY
+	if !lo.readOnly {
+		flag = os.O_RDWR | os.O_CREATE
+		if err := os.MkdirAll(lo.resolve(systemFolderName), defaultDirPermissions); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(lo.resolve(systemFolderName, lockFileName), flag, defaultPermissions)
+	if err != nil {
+		return err
+	}
+	lo.lock.file = f
+	lo.lock.reload = lo.reload
+	// The metadata is loaded right after this, so the saves made so far are already seen
+	lo.lock.generation, err = lo.lock.saves()
+	if err != nil {
+		f.Close()
+	}
+	return err
+}
+
+// Close releases the lock file of the shared root, changes fail with os.ErrClosed after that.
+// Closing the overlays that do not share the root does nothing.
+func (lo *localOverlay) Close() error {
+	lo.lock.RWMutex.Lock()
+	defer lo.lock.RWMutex.Unlock()
+
+	if lo.lock.file == nil || lo.lock.closed {
+		return nil
+	}
+	lo.lock.closed = true
+	return lo.lock.file.Close()
+}
+
+// reload replaces the metadata with the one saved by another process, keeping the access times of
+// this process for the files that did not change. The lock must be held by the caller.
+func (lo *localOverlay) reload() error {
+	pending := lo.pending
+	lo.pending = map[string]*FileMetadata{}
+	if _, err := lo.loadMetadata(); err != nil {
+		lo.pending = pending
+		return err
+	}
+	for name, md := range pending {
+		current := lo.metadata.FileMetadata[name]
+		if md == nil || current == nil || current.Sha256 != md.Sha256 || !current.Modified.Equal(md.Modified) {
+			continue
+		}
+		if md.Accessed.After(current.Accessed) {
+			accessed := *current
+			accessed.Accessed = md.Accessed
+			lo.setEntry(name, &accessed)
+		}
+	}
+	lo.watchers.notify(Event{Type: EventOverflow})
+	return nil
+}
@@ -0,0 +1,196 @@
+package almostio
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSharedRoot(t *testing.T) {
+
+	for _, tc := range []struct {
+		name    string
+		options []LocalOverlayOption
+	}{
+		{name: "Snapshot store"},
+		{name: "Log store", options: []LocalOverlayOption{WithLogMetadataStore()}},
+		{name: "Content addressed", options: []LocalOverlayOption{WithContentAddressing()}},
+	} {
+		options := append(tc.options, WithSharedRoot())
+		t.Run(tc.name+" changes are visible to others", func(t *testing.T) {
+			first := newTestOverlay(t, "", options...)
+			second := newTestOverlay(t, first.root, options...)
+
+			writeOverlayFile(first, "File 1", []byte("File 1"))
+			writeOverlayFile(second, "File 2", []byte("File 2"))
+			if data, err := readOverlayFile(second, "File 1"); err != nil || string(data) != "File 1" {
+				t.Errorf("Expected file from other overlay, but got %q, %v", data, err)
+			}
+
+			first.Rename("File 2", "File 3")
+			second.Delete("File 1")
+			if names := listNames(first); !reflect.DeepEqual(names, []string{"File 3"}) {
+				t.Errorf("Expected changes of both overlays, but got %v", names)
+			}
+			if md := second.GetMetadata([]string{"File 3"})[0]; md == nil {
+				t.Errorf("Expected renamed file to be found")
+			}
+
+			reopened := newTestOverlay(t, first.root, options...)
+			if names := listNames(reopened); !reflect.DeepEqual(names, []string{"File 3"}) {
+				t.Errorf("Expected all changes to be saved, but got %v", names)
+			}
+			if report := must(Verify(reopened, VerifyOptions{})); !report.IsClean() {
+				t.Errorf("Expected consistent overlay, but got %v", report)
+			}
+		})
+	}
+
+	t.Run("Concurrent writes", func(t *testing.T) {
+		root := filepath.Join(t.TempDir(), "overlay_root")
+		overlays := []Overlay{}
+		for range concurrentWorkers {
+			overlays = append(overlays, newTestOverlay(t, root, WithSharedRoot()))
+		}
+
+		runConcurrently(concurrentWorkers, func(worker int) {
+			for i := range concurrentIterations / 5 {
+				name := fmt.Sprintf("Worker %d file %d", worker, i)
+				if err := writeOverlayFile(overlays[worker], name, payload(worker, i)); err != nil {
+					t.Errorf("Cannot write %s: %v", name, err)
+				}
+				writeOverlayFile(overlays[worker], "Common", payload(worker, i))
+			}
+		})
+
+		reopened := newTestOverlay(t, root, WithSharedRoot())
+		if files := listNames(reopened); len(files) != concurrentWorkers*concurrentIterations/5+1 {
+			t.Errorf("Expected files of all workers, but got %d: %v", len(files), files)
+		}
+		if data := must(readOverlayFile(reopened, "Common")); !isPayload(data) {
+			t.Errorf("Expected common file to have complete content, but got %q", data)
+		}
+		if report := must(Verify(reopened, VerifyOptions{})); !report.IsClean() {
+			t.Errorf("Expected consistent overlay, but got %v", report)
+		}
+	})
+
+	t.Run("Writes of others are kept on start", func(t *testing.T) {
+		first := newTestOverlay(t, "", WithSharedRoot())
+		w := must(first.OpenWrite("File 1"))
+		w.Write([]byte("File 1"))
+
+		newTestOverlay(t, first.root, WithSharedRoot())
+		if err := w.Close(); err != nil {
+			t.Errorf("Expected write to finish, but got %v", err)
+		}
+		if data, err := readOverlayFile(first, "File 1"); err != nil || string(data) != "File 1" {
+			t.Errorf("Expected written file, but got %q, %v", data, err)
+		}
+	})
+
+	t.Run("GC keeps temp files of others", func(t *testing.T) {
+		first := newTestOverlay(t, "", WithSharedRoot())
+		second := newTestOverlay(t, first.root, WithSharedRoot())
+		w := must(first.OpenWrite("File 1"))
+		w.Write([]byte("File 1"))
+		stale := filepath.Join(first.root, systemFolderName, tempFolderName, "write-stale")
+		os.WriteFile(stale, []byte("Stale"), defaultPermissions)
+		old := time.Now().Add(-2 * sharedTempFileAge)
+		os.Chtimes(stale, old, old)
+
+		report, err := GC(second, GCOptions{})
+		if err != nil || !reflect.DeepEqual(report.TempFiles, []string{".overlay/tmp/write-stale"}) {
+			t.Errorf("Expected only the stale temp file to be collected, but got %v, %v", report, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Errorf("Expected write to finish, but got %v", err)
+		}
+	})
+
+	t.Run("Watchers are told to catch up", func(t *testing.T) {
+		first := newTestOverlay(t, "", WithSharedRoot())
+		second := newTestOverlay(t, first.root, WithSharedRoot())
+		w := second.Watch("")
+		defer w.Close()
+
+		writeOverlayFile(first, "File 1", []byte("File 1"))
+		writeOverlayFile(second, "File 2", []byte("File 2"))
+		if events := pendingEvents(w); !reflect.DeepEqual(events, []string{"overflow", "created File 2"}) {
+			t.Errorf("Expected overflow before own changes, but got %v", events)
+		}
+	})
+
+	t.Run("Access times are kept on reload", func(t *testing.T) {
+		clock := &fakeClock{now: time.Now().Add(time.Hour)}
+		first := newTestOverlay(t, "", WithSharedRoot())
+		second := newTestOverlay(t, first.root, WithSharedRoot(), withClock(clock))
+		writeOverlayFile(first, "File 1", []byte("File 1"))
+		readOverlayFile(second, "File 1")
+		accessed := second.GetMetadata([]string{"File 1"})[0].Accessed
+
+		writeOverlayFile(first, "File 2", []byte("File 2"))
+		if md := second.GetMetadata([]string{"File 1"})[0]; !md.Accessed.Equal(accessed) {
+			t.Errorf("Expected access time %v, but got %v", accessed, md.Accessed)
+		}
+	})
+
+	t.Run("Read-only overlay sees changes", func(t *testing.T) {
+		writer := newTestOverlay(t, "", WithSharedRoot())
+		reader := newTestOverlay(t, writer.root, WithSharedRoot(), WithReadOnly())
+
+		writeOverlayFile(writer, "File 1", []byte("File 1"))
+		if data, err := readOverlayFile(reader, "File 1"); err != nil || string(data) != "File 1" {
+			t.Errorf("Expected changes of the writer, but got %q, %v", data, err)
+		}
+	})
+
+	t.Run("Lock file is closed", func(t *testing.T) {
+		if _, err := os.ReadDir("/proc/self/fd"); err != nil {
+			t.Skip("Cannot list open files")
+		}
+		root := filepath.Join(t.TempDir(), "overlay_root")
+		lockPath := filepath.Join(root, systemFolderName, lockFileName)
+		openLocks := func() int {
+			count := 0
+			for _, fd := range must(os.ReadDir("/proc/self/fd")) {
+				if target, _ := os.Readlink(filepath.Join("/proc/self/fd", fd.Name())); target == lockPath {
+					count++
+				}
+			}
+			return count
+		}
+
+		var o Overlay = newTestOverlay(t, root, WithSharedRoot())
+		writeOverlayFile(o, "File 1", []byte("File 1"))
+		if err := o.(io.Closer).Close(); err != nil || openLocks() != 0 {
+			t.Errorf("Expected lock file to be closed, but got %d open, %v", openLocks(), err)
+		}
+		if err := writeOverlayFile(o, "File 2", []byte("File 2")); !errors.Is(err, os.ErrClosed) {
+			t.Errorf("Expected write to a closed overlay to fail, but got %v", err)
+		}
+
+		if _, err := NewLocalOverlay(root, NewJsonMarshal[OverlayMetadata](), WithSharedRoot(), withUpgrades()); !errors.Is(err, ErrUnsupportedSchema) {
+			t.Errorf("Expected unsupported schema error, but got %v", err)
+		}
+		if count := openLocks(); count != 0 {
+			t.Errorf("Expected lock file to be closed on error, but got %d open", count)
+		}
+
+		if err := MigrateLocalOverlay(root, NewJsonMarshal[OverlayMetadata](), WithSharedRoot(), WithSharding(2)); err != nil || openLocks() != 0 {
+			t.Errorf("Expected lock file to be closed after migration, but got %d open, %v", openLocks(), err)
+		}
+	})
+
+	t.Run("Read-only overlay needs lock file", func(t *testing.T) {
+		_, err := NewLocalOverlay(filepath.Join(t.TempDir(), "overlay_root"), NewJsonMarshal[OverlayMetadata](), WithSharedRoot(), WithReadOnly())
+		if !os.IsNotExist(err) {
+			t.Errorf("Expected missing lock file, but got %v", err)
+		}
+	})
+}
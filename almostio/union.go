@@ -0,0 +1,308 @@
+package almostio
+
+import (
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// whiteoutAttribute marks an entry in the upper layer that hides the file from the lower layers.
+const whiteoutAttribute = "overlay.whiteout"
+
+type unionOverlay struct {
+	Overlay
+
+	// lock serializes the operations that touch several layers.
+	lock sync.Mutex
+
+	upper       Overlay
+	lowers      []Overlay
+	readThrough bool
+}
+
+func isWhiteout(md *FileMetadata) bool {
+	return md != nil && md.Attributes[whiteoutAttribute] != ""
+}
+
+// find returns the layer with the file and its metadata, or nil if there is no such file or it is
+// deleted.
+func (uo *unionOverlay) find(name string) (Overlay, *FileMetadata) {
+	if md := uo.upper.GetMetadata([]string{name})[0]; md != nil {
+		if isWhiteout(md) {
+			return nil, nil
+		}
+		return uo.upper, md
+	}
+	for _, lower := range uo.lowers {
+		if md := lower.GetMetadata([]string{name})[0]; md != nil {
+			return lower, md
+		}
+	}
+	return nil, nil
+}
+
+// inLowers checks if any of the lower layers has the file, even if it is hidden.
+func (uo *unionOverlay) inLowers(name string) bool {
+	for _, lower := range uo.lowers {
+		if lower.GetMetadata([]string{name})[0] != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// clearWhiteout adds an option that removes the whiteout of the replaced file, if there is one.
+func clearWhiteout(options []WriteOption) []WriteOption {
+	return append(options, func(wo *writeOptions) {
+		attributes := map[string]string{whiteoutAttribute: ""}
+		for k, v := range wo.attributes {
+			attributes[k] = v
+		}
+		wo.attributes = attributes
+	})
+}
+
+// copyUp copies the file from the lower layer to the upper one as newName, keeping attributes.
+func (uo *unionOverlay) copyUp(layer Overlay, md *FileMetadata, newName string) error {
+	r, err := layer.OpenRead(md.Name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := uo.upper.OpenWrite(newName, clearWhiteout([]WriteOption{
+		WithAttributes(md.Attributes),
+		WithContentType(md.Mime),
+		withIncomplete(md.Incomplete),
+	})...)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// toUpper copies the file to the upper layer if it is in the lower one.
+func (uo *unionOverlay) toUpper(name string) error {
+	layer, md := uo.find(name)
+	if layer == nil {
+		return os.ErrNotExist
+	}
+	if layer == uo.upper {
+		return nil
+	}
+	return uo.copyUp(layer, md, name)
+}
+
+// whiteout hides the file from the lower layers, replacing the file in the upper one.
+func (uo *unionOverlay) whiteout(name string) error {
+	w, err := uo.upper.OpenWrite(name, WithAttributes(map[string]string{whiteoutAttribute: "true"}))
+	if err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// openLayer finds the layer to read the file from, copying the file to the upper layer in the
+// read-through mode.
+func (uo *unionOverlay) openLayer(name string) (Overlay, error) {
+	layer, md := uo.find(name)
+	if layer == nil {
+		return nil, os.ErrNotExist
+	}
+	if !uo.readThrough || layer == uo.upper {
+		return layer, nil
+	}
+
+	uo.lock.Lock()
+	defer uo.lock.Unlock()
+	if err := uo.copyUp(layer, md, name); err != nil {
+		return nil, err
+	}
+	return uo.upper, nil
+}
+
+func (uo *unionOverlay) OpenRead(name string) (io.ReadCloser, error) {
+	layer, err := uo.openLayer(name)
+	if err != nil {
+		return nil, err
+	}
+	return layer.OpenRead(name)
+}
+
+func (uo *unionOverlay) OpenSeekable(name string) (SeekableReader, error) {
+	layer, err := uo.openLayer(name)
+	if err != nil {
+		return nil, err
+	}
+	return layer.OpenSeekable(name)
+}
+
+func (uo *unionOverlay) OpenWrite(name string, options ...WriteOption) (io.WriteCloser, error) {
+	return uo.upper.OpenWrite(name, clearWhiteout(options)...)
+}
+
+// OpenAppend copies the file to the upper layer and continues writing it there.
+func (uo *unionOverlay) OpenAppend(name string, options ...WriteOption) (io.WriteCloser, error) {
+	uo.lock.Lock()
+	defer uo.lock.Unlock()
+
+	if err := uo.toUpper(name); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return uo.upper.OpenAppend(name, clearWhiteout(options)...)
+}
+
+func (uo *unionOverlay) Finalize(name string) error {
+	uo.lock.Lock()
+	defer uo.lock.Unlock()
+
+	if err := uo.toUpper(name); err != nil {
+		return err
+	}
+	return uo.upper.Finalize(name)
+}
+
+func (uo *unionOverlay) SetAttributes(name string, attributes map[string]string) error {
+	uo.lock.Lock()
+	defer uo.lock.Unlock()
+
+	if err := uo.toUpper(name); err != nil {
+		return err
+	}
+	return uo.upper.SetAttributes(name, attributes)
+}
+
+func (uo *unionOverlay) GetMetadata(names []string) []*FileMetadata {
+	result := make([]*FileMetadata, len(names))
+	for i, name := range names {
+		_, result[i] = uo.find(name)
+	}
+	return result
+}
+
+// Delete removes the file from the upper layer and records a whiteout if lower layers have it.
+func (uo *unionOverlay) Delete(name string) error {
+	uo.lock.Lock()
+	defer uo.lock.Unlock()
+
+	if layer, _ := uo.find(name); layer == nil {
+		return os.ErrNotExist
+	}
+	if uo.inLowers(name) {
+		return uo.whiteout(name)
+	}
+	return uo.upper.Delete(name)
+}
+
+// Rename copies the file to the upper layer with the new name and hides the old one.
+func (uo *unionOverlay) Rename(oldName string, newName string) error {
+	uo.lock.Lock()
+	defer uo.lock.Unlock()
+
+	layer, md := uo.find(oldName)
+	if layer == nil {
+		return os.ErrNotExist
+	}
+	if oldName == newName {
+		return nil
+	}
+
+	if layer == uo.upper {
+		if err := uo.upper.Rename(oldName, newName); err != nil {
+			return err
+		}
+	} else if err := uo.copyUp(layer, md, newName); err != nil {
+		return err
+	}
+	if uo.inLowers(oldName) {
+		return uo.whiteout(oldName)
+	}
+	return nil
+}
+
+// List merges the files from all layers, the upper layers hide the files with the same names.
+func (uo *unionOverlay) List(prefix string) []*FileMetadata {
+	seen := map[string]bool{}
+	result := []*FileMetadata{}
+	for _, layer := range append([]Overlay{uo.upper}, uo.lowers...) {
+		for _, md := range layer.List(prefix) {
+			if seen[md.Name] {
+				continue
+			}
+			seen[md.Name] = true
+			if !isWhiteout(md) {
+				result = append(result, md)
+			}
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// NewUnionOverlay combines the overlays into one, the files are read from the first layer that
+// has them, starting from the upper one. All changes go to the upper layer: the files from the
+// lower layers are copied there before modification and deleted files are hidden with whiteouts,
+// the entries with the "overlay.whiteout" attribute.
+func NewUnionOverlay(upper Overlay, lowers ...Overlay) Overlay {
+	return &unionOverlay{
+		upper:  upper,
+		lowers: lowers,
+	}
+}
+
+// NewReadThroughOverlay is a union overlay that copies the files to the upper layer when they are
+// read, so the upper layer works as a cache for the slower lower ones.
+func NewReadThroughOverlay(upper Overlay, lowers ...Overlay) Overlay {
+	return &unionOverlay{
+		upper:       upper,
+		lowers:      lowers,
+		readThrough: true,
+	}
+}
+
+// Watch reports the changes made through the union overlay, the changes made directly in the
+// lower layers are not reported. Writing a file hidden with a whiteout is reported as an update.
+func (uo *unionOverlay) Watch(prefix string) *Watcher {
+	upper := uo.upper.Watch(prefix)
+	w := newWatcher(prefix, upper.Close)
+	go func() {
+		for event := range upper.Events {
+			w.send(uo.unionEvent(event))
+		}
+		w.Close()
+	}()
+	return w
+}
+
+// unionEvent converts the upper layer event to the change of the union.
+func (uo *unionOverlay) unionEvent(event Event) Event {
+	if event.Type == EventOverflow {
+		return event
+	}
+	name := event.Metadata.Name
+	switch event.Type {
+	case EventCreated, EventUpdated:
+		if isWhiteout(event.Metadata) {
+			return Event{Type: EventDeleted, Metadata: event.Metadata}
+		}
+		if event.Type == EventCreated && uo.inLowers(name) {
+			return Event{Type: EventUpdated, Metadata: event.Metadata}
+		}
+	case EventDeleted, EventEvicted:
+		// The file from the lower layer becomes visible
+		if _, md := uo.find(name); md != nil {
+			if isWhiteout(event.Metadata) {
+				return Event{Type: EventCreated, Metadata: md}
+			}
+			return Event{Type: EventUpdated, Metadata: md}
+		}
+	}
+	return event
+}
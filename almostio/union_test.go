@@ -0,0 +1,171 @@
+package almostio
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func newUnionLayers(t *testing.T) (*MemoryOverlay, *MemoryOverlay, *MemoryOverlay) {
+	upper := NewMemoryOverlay()
+	middle := NewMemoryOverlay()
+	lower := NewMemoryOverlay()
+	writeOverlayFile(middle, "Shared", []byte("middle"))
+	writeOverlayFile(middle, "Middle", []byte("middle"))
+	writeOverlayFile(lower, "Shared", []byte("lower"))
+	writeOverlayFile(lower, "Lower", []byte("lower"))
+	return upper, middle, lower
+}
+
+func TestUnionOverlay(t *testing.T) {
+
+	t.Run("Reads fall through to lower layers", func(t *testing.T) {
+		upper, middle, lower := newUnionLayers(t)
+		o := NewUnionOverlay(upper, middle, lower)
+		writeOverlayFile(upper, "Upper", []byte("upper"))
+
+		for name, want := range map[string]string{
+			"Upper":  "upper",
+			"Shared": "middle",
+			"Middle": "middle",
+			"Lower":  "lower",
+		} {
+			if got, err := readOverlayFile(o, name); err != nil || string(got) != want {
+				t.Errorf("Expected %s to be %q, but got %q, %v", name, want, got, err)
+			}
+		}
+		if names := listNames(o); !reflect.DeepEqual(names, []string{"Lower", "Middle", "Shared", "Upper"}) {
+			t.Errorf("Expected files from all layers, but got %v", names)
+		}
+		if len(upper.List("")) != 1 {
+			t.Errorf("Expected reads not to change the upper layer")
+		}
+	})
+
+	t.Run("Writes go to upper layer", func(t *testing.T) {
+		upper, middle, lower := newUnionLayers(t)
+		o := NewUnionOverlay(upper, middle, lower)
+		writeOverlayFile(o, "Shared", []byte("upper"))
+
+		if got := must(readOverlayFile(o, "Shared")); string(got) != "upper" {
+			t.Errorf("Expected upper layer to hide lower ones, but got %q", got)
+		}
+		if got := must(readOverlayFile(middle, "Shared")); string(got) != "middle" {
+			t.Errorf("Expected lower layer to be unchanged, but got %q", got)
+		}
+	})
+
+	t.Run("Modifications copy files to upper layer", func(t *testing.T) {
+		upper, middle, lower := newUnionLayers(t)
+		lower.SetAttributes("Lower", map[string]string{"source": "lower"})
+		o := NewUnionOverlay(upper, middle, lower)
+
+		o.SetAttributes("Lower", map[string]string{"owner": "me"})
+		w := must(o.OpenAppend("Middle"))
+		w.Write([]byte(" appended"))
+		w.Close()
+
+		if md := upper.GetMetadata([]string{"Lower"})[0]; md == nil ||
+			!reflect.DeepEqual(md.Attributes, map[string]string{"source": "lower", "owner": "me"}) {
+			t.Errorf("Expected file with merged attributes in upper layer, but got %v", md)
+		}
+		if got := must(readOverlayFile(upper, "Middle")); string(got) != "middle appended" {
+			t.Errorf("Expected appended file in upper layer, but got %q", got)
+		}
+		if md := lower.GetMetadata([]string{"Lower"})[0]; !reflect.DeepEqual(md.Attributes, map[string]string{"source": "lower"}) {
+			t.Errorf("Expected lower layer to be unchanged, but got %v", md.Attributes)
+		}
+	})
+
+	t.Run("Delete records whiteouts", func(t *testing.T) {
+		upper, middle, lower := newUnionLayers(t)
+		o := NewUnionOverlay(upper, middle, lower)
+		writeOverlayFile(o, "Upper", []byte("upper"))
+
+		for _, name := range []string{"Upper", "Shared", "Lower"} {
+			if err := o.Delete(name); err != nil {
+				t.Errorf("Cannot delete %s: %v", name, err)
+			}
+		}
+		if names := listNames(o); !reflect.DeepEqual(names, []string{"Middle"}) {
+			t.Errorf("Expected deleted files to be hidden, but got %v", names)
+		}
+		if _, err := readOverlayFile(o, "Shared"); err == nil {
+			t.Errorf("Expected deleted file not to be readable")
+		}
+		if md := o.GetMetadata([]string{"Lower"})[0]; md != nil {
+			t.Errorf("Expected no metadata for deleted file, but got %v", md)
+		}
+		if err := o.Delete("Lower"); err == nil {
+			t.Errorf("Expected error when deleting already deleted file")
+		}
+		if names := listNames(upper); !reflect.DeepEqual(names, []string{"Lower", "Shared"}) {
+			t.Errorf("Expected whiteouts only for lower files, but got %v", names)
+		}
+		if names := listNames(lower); !reflect.DeepEqual(names, []string{"Lower", "Shared"}) {
+			t.Errorf("Expected lower layer to be unchanged, but got %v", names)
+		}
+
+		writeOverlayFile(o, "Shared", []byte("restored"))
+		if got := must(readOverlayFile(o, "Shared")); string(got) != "restored" {
+			t.Errorf("Expected write to replace whiteout, but got %q", got)
+		}
+		if md := o.GetMetadata([]string{"Shared"})[0]; md.Attributes != nil {
+			t.Errorf("Expected no whiteout attribute, but got %v", md.Attributes)
+		}
+
+		o.Delete("Shared")
+		w := must(o.OpenWrite("Shared", WithMergedAttributes()))
+		w.Close()
+		if md := o.GetMetadata([]string{"Shared"})[0]; md == nil || md.Attributes != nil {
+			t.Errorf("Expected merged write to drop the whiteout, but got %v", md)
+		}
+	})
+
+	t.Run("Rename hides old name", func(t *testing.T) {
+		upper, middle, lower := newUnionLayers(t)
+		o := NewUnionOverlay(upper, middle, lower)
+
+		if err := o.Rename("Lower", "Renamed"); err != nil {
+			t.Errorf("Cannot rename: %v", err)
+		}
+		if names := listNames(o); !reflect.DeepEqual(names, []string{"Middle", "Renamed", "Shared"}) {
+			t.Errorf("Expected renamed file, but got %v", names)
+		}
+		if got := must(readOverlayFile(o, "Renamed")); string(got) != "lower" {
+			t.Errorf("Expected renamed content, but got %q", got)
+		}
+	})
+
+	t.Run("Whiteouts are persistent", func(t *testing.T) {
+		root := filepath.Join(t.TempDir(), "overlay_root")
+		_, middle, lower := newUnionLayers(t)
+		upper := must(NewLocalOverlay(root, NewJsonMarshal[OverlayMetadata]()))
+		NewUnionOverlay(upper, middle, lower).Delete("Shared")
+
+		upper = must(NewLocalOverlay(root, NewJsonMarshal[OverlayMetadata]()))
+		if names := listNames(NewUnionOverlay(upper, middle, lower)); !reflect.DeepEqual(names, []string{"Lower", "Middle"}) {
+			t.Errorf("Expected deleted file to stay hidden, but got %v", names)
+		}
+	})
+
+	t.Run("Read-through populates upper layer", func(t *testing.T) {
+		upper, middle, lower := newUnionLayers(t)
+		o := NewReadThroughOverlay(upper, middle, lower)
+
+		if got := must(readOverlayFile(o, "Lower")); string(got) != "lower" {
+			t.Errorf("Expected file from lower layer, but got %q", got)
+		}
+		if got, err := readOverlayFile(upper, "Lower"); err != nil || string(got) != "lower" {
+			t.Errorf("Expected file to be copied to upper layer, but got %q, %v", got, err)
+		}
+		if names := listNames(upper); !reflect.DeepEqual(names, []string{"Lower"}) {
+			t.Errorf("Expected only read file in upper layer, but got %v", names)
+		}
+
+		lower.Delete("Lower")
+		if got, err := readOverlayFile(o, "Lower"); err != nil || string(got) != "lower" {
+			t.Errorf("Expected cached file, but got %q, %v", got, err)
+		}
+	})
+}
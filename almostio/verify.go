@@ -0,0 +1,269 @@
+package almostio
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// VerifyOptions configures the overlay verification.
+type VerifyOptions struct {
+	// Workers is the number of files checked in parallel, defaults to the number of CPUs.
+	Workers int
+	// Repair fixes the metadata of local overlays: removes missing files, updates corrupted ones
+	// with the actual content keeping their mime types and adds untracked local files using their
+	// local names as the names.
+	// Unreadable files are kept as they are, the repair fails if the files were written with codecs
+	// that are not configured.
+	Repair bool
+}
+
+// VerifyReport contains the verification results, all the lists are sorted.
+type VerifyReport struct {
+	// Checked is the number of files checked.
+	Checked int
+	// Missing are the names of the files without local files.
+	Missing []string
+	// Corrupted are the names of the files with content not matching the sha256.
+	Corrupted []string
+	// Unreadable are the names of the files that exist but cannot be read, e.g. because of the
+	// permissions or unknown codecs.
+	Unreadable []string
+	// Orphaned are the local files not referenced by any file.
+	Orphaned []string
+	// Reindexed are the names of the files added to the metadata during the repair.
+	Reindexed []string
+}
+
+// IsClean checks if the verification found no problems.
+func (vr *VerifyReport) IsClean() bool {
+	return len(vr.Missing) == 0 && len(vr.Corrupted) == 0 && len(vr.Unreadable) == 0 && len(vr.Orphaned) == 0
+}
+
+// verifiable is an overlay that knows about its local files.
+type verifiable interface {
+	openLocal(md *FileMetadata) (io.ReadCloser, error)
+	untrackedFiles() ([]string, error)
+	// repair applies the scan results, missing and corrupted entries are the ones scanned and
+	// corrupted maps them to the fixed metadata.
+	repair(missing []*FileMetadata, corrupted map[*FileMetadata]*FileMetadata, untracked []*FileMetadata) error
+	contentTypeDetector() ContentTypeDetector
+}
+
+// Verify recalculates the sha256 of all files in parallel and compares it to the metadata. For
+// local overlays, the local files not referenced by metadata are reported as orphans.
+func Verify(o Overlay, options VerifyOptions) (*VerifyReport, error) {
+	open := func(md *FileMetadata) (io.ReadCloser, error) {
+		return o.OpenRead(md.Name)
+	}
+	detector := NewHTTPContentTypeDetector()
+	vo, isVerifiable := o.(verifiable)
+	if isVerifiable {
+		open = vo.openLocal
+		detector = vo.contentTypeDetector()
+	}
+
+	entries := o.List("")
+	actual, errs := hashAll(entries, options.Workers, open, detector)
+
+	report := &VerifyReport{
+		Checked:    len(entries),
+		Missing:    []string{},
+		Corrupted:  []string{},
+		Unreadable: []string{},
+		Orphaned:   []string{},
+		Reindexed:  []string{},
+	}
+	missing := []*FileMetadata{}
+	corrupted := map[*FileMetadata]*FileMetadata{}
+	for i, md := range entries {
+		switch {
+		case errors.Is(errs[i], os.ErrNotExist):
+			report.Missing = append(report.Missing, md.Name)
+			missing = append(missing, md)
+		case errs[i] != nil:
+			report.Unreadable = append(report.Unreadable, md.Name)
+		case actual[i].Sha256 != md.Sha256:
+			report.Corrupted = append(report.Corrupted, md.Name)
+			fixed := *md
+			fixed.Sha256 = actual[i].Sha256
+			fixed.Size = actual[i].Size
+			corrupted[md] = &fixed
+		}
+	}
+	if !isVerifiable {
+		return report, nil
+	}
+
+	orphans, err := vo.untrackedFiles()
+	if err != nil {
+		return nil, err
+	}
+	report.Orphaned = orphans
+	if !options.Repair {
+		return report, nil
+	}
+
+	untracked := []*FileMetadata{}
+	orphanMetadata := make([]*FileMetadata, len(orphans))
+	for i, localName := range orphans {
+		orphanMetadata[i] = &FileMetadata{Name: localName, LocalName: localName}
+	}
+	orphanActual, _ := hashAll(orphanMetadata, options.Workers, vo.openLocal, detector)
+	for i, md := range orphanActual {
+		if md == nil {
+			continue
+		}
+		md.Name = orphans[i]
+		md.LocalName = orphans[i]
+		untracked = append(untracked, md)
+		report.Reindexed = append(report.Reindexed, md.Name)
+	}
+	if err := vo.repair(missing, corrupted, untracked); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// hashAll reads the files in parallel and returns their actual metadata, nil with the error for
+// the files that cannot be read.
+func hashAll(entries []*FileMetadata, workers int, open func(*FileMetadata) (io.ReadCloser, error), detector ContentTypeDetector) ([]*FileMetadata, []error) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	result := make([]*FileMetadata, len(entries))
+	errs := make([]error, len(entries))
+	indices := make(chan int)
+	wg := sync.WaitGroup{}
+	wg.Add(workers)
+	for range workers {
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				result[i], errs[i] = hashFile(entries[i], open, detector)
+			}
+		}()
+	}
+	for i := range entries {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+	return result, errs
+}
+
+func hashFile(md *FileMetadata, open func(*FileMetadata) (io.ReadCloser, error), detector ContentTypeDetector) (*FileMetadata, error) {
+	r, err := open(md)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var result *FileMetadata
+	detect := func(head []byte) string {
+		return detector.DetectContentType(md.Name, head)
+	}
+	w := newContentWriter(NopWriteCloser(io.Discard), nowFunc(md), detect, func(fmd *FileMetadata) error {
+		result = fmd
+		return nil
+	})
+	if _, err := io.Copy(w, r); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// nowFunc returns the modification time of the file as the current time, so the recalculated
+// metadata keeps the original timestamps.
+func nowFunc(md *FileMetadata) func() time.Time {
+	return func() time.Time {
+		return md.Modified
+	}
+}
+
+func (lo *localOverlay) openLocal(md *FileMetadata) (io.ReadCloser, error) {
+	f, err := os.Open(lo.resolve(md.LocalName))
+	if err != nil {
+		return nil, err
+	}
+	return lo.decode(f, md)
+}
+
+func (lo *localOverlay) contentTypeDetector() ContentTypeDetector {
+	return lo.detector
+}
+
+func (lo *localOverlay) untrackedFiles() ([]string, error) {
+	lo.lock.RLock()
+	defer lo.lock.RUnlock()
+
+	result := []string{}
+	err := filepath.WalkDir(lo.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		localName, err := filepath.Rel(lo.root, path)
+		if err != nil {
+			return err
+		}
+		localName = filepath.ToSlash(localName)
+		if d.IsDir() {
+			if localName == systemFolderName {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if lo.refs[localName] == 0 {
+			result = append(result, localName)
+		}
+		return nil
+	})
+	sort.Strings(result)
+	return result, err
+}
+
+func (lo *localOverlay) repair(missing []*FileMetadata, corrupted map[*FileMetadata]*FileMetadata, untracked []*FileMetadata) error {
+	lo.lock.Lock()
+	defer lo.lock.Unlock()
+
+	if err := lo.checkWritable(); err != nil {
+		return err
+	}
+	// Files of unknown codecs cannot be checked, so the repair could drop good files
+	for _, md := range lo.metadata.FileMetadata {
+		if err := lo.checkCodecs(md); err != nil {
+			return fmt.Errorf("cannot repair: %w", err)
+		}
+	}
+	// Entries are compared by pointer, so the files changed since the scan are kept
+	for _, md := range missing {
+		if lo.metadata.FileMetadata[md.Name] == md {
+			lo.setEntry(md.Name, nil)
+		}
+	}
+	for scanned, fixed := range corrupted {
+		if lo.metadata.FileMetadata[scanned.Name] == scanned {
+			lo.setEntry(fixed.Name, fixed)
+		}
+	}
+	for _, md := range untracked {
+		if _, ok := lo.metadata.FileMetadata[md.Name]; !ok && lo.refs[md.LocalName] == 0 {
+			ts := lo.now()
+			md.Created = ts
+			md.Modified = ts
+			md.Accessed = ts
+			lo.setEntry(md.Name, md)
+		}
+	}
+	return lo.writeMetadata()
+}
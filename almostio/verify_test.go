@@ -0,0 +1,160 @@
+package almostio
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// changingOverlay runs the change after the files were checked, but before the repair.
+type changingOverlay struct {
+	*localOverlay
+
+	change func()
+}
+
+func (co *changingOverlay) untrackedFiles() ([]string, error) {
+	co.change()
+	return co.localOverlay.untrackedFiles()
+}
+
+func TestVerify(t *testing.T) {
+
+	newOverlay := func(t *testing.T) (Overlay, string) {
+		root := filepath.Join(t.TempDir(), "overlay_root")
+		o, err := NewLocalOverlay(root, NewJsonMarshal[OverlayMetadata]())
+		if err != nil {
+			t.Fatalf("Error while starting an overlay: %v", err)
+		}
+		for _, name := range []string{"File 1", "File 2", "File 3"} {
+			writeOverlayFile(o, name, []byte(name))
+		}
+		return o, root
+	}
+
+	t.Run("Clean overlay", func(t *testing.T) {
+		o, _ := newOverlay(t)
+		report, err := Verify(o, VerifyOptions{})
+		if err != nil || !report.IsClean() || report.Checked != 3 {
+			t.Errorf("Expected clean report for 3 files, but got %v, %v", report, err)
+		}
+	})
+
+	t.Run("Missing, corrupted and orphaned files", func(t *testing.T) {
+		o, root := newOverlay(t)
+		os.Remove(filepath.Join(root, "644fe258_File_1"))
+		os.WriteFile(filepath.Join(root, "674fe711_File_2"), []byte("Changed"), defaultPermissions)
+		os.WriteFile(filepath.Join(root, "untracked"), []byte("Untracked"), defaultPermissions)
+
+		report, err := Verify(o, VerifyOptions{Workers: 2})
+		want := &VerifyReport{
+			Checked:    3,
+			Missing:    []string{"File 1"},
+			Corrupted:  []string{"File 2"},
+			Unreadable: []string{},
+			Orphaned:   []string{"untracked"},
+			Reindexed:  []string{},
+		}
+		if err != nil || !reflect.DeepEqual(report, want) {
+			t.Errorf("Expected report %v, but got %v, %v", want, report, err)
+		}
+	})
+
+	t.Run("Repair", func(t *testing.T) {
+		o, root := newOverlay(t)
+		os.Remove(filepath.Join(root, "644fe258_File_1"))
+		os.WriteFile(filepath.Join(root, "674fe711_File_2"), []byte("Changed"), defaultPermissions)
+		os.WriteFile(filepath.Join(root, "untracked"), []byte("Untracked"), defaultPermissions)
+
+		report, err := Verify(o, VerifyOptions{Repair: true})
+		if err != nil || !reflect.DeepEqual(report.Reindexed, []string{"untracked"}) {
+			t.Errorf("Expected untracked file to be reindexed, but got %v, %v", report, err)
+		}
+
+		reopened, _ := NewLocalOverlay(root, NewJsonMarshal[OverlayMetadata]())
+		if names := listNames(reopened); !reflect.DeepEqual(names, []string{"File 2", "File 3", "untracked"}) {
+			t.Errorf("Expected repaired file list, but got %v", names)
+		}
+		if data, err := readOverlayFile(reopened, "untracked"); err != nil || string(data) != "Untracked" {
+			t.Errorf("Expected reindexed file to be readable, but got %q, %v", data, err)
+		}
+		if report, err := Verify(reopened, VerifyOptions{}); err != nil || !report.IsClean() {
+			t.Errorf("Expected repaired overlay to be clean, but got %v, %v", report, err)
+		}
+	})
+
+	t.Run("Repair keeps mime types", func(t *testing.T) {
+		root := filepath.Join(t.TempDir(), "overlay_root")
+		o, err := NewLocalOverlay(root, NewJsonMarshal[OverlayMetadata](), WithContentTypeDetector(NewExtendedContentTypeDetector()))
+		if err != nil {
+			t.Fatalf("Error while starting an overlay: %v", err)
+		}
+		w := must(o.OpenWrite("File 1", WithContentType("text/x-custom")))
+		w.Write([]byte("File 1"))
+		w.Close()
+		os.WriteFile(filepath.Join(root, "644fe258_File_1"), []byte("Changed"), defaultPermissions)
+		os.WriteFile(filepath.Join(root, "untracked"), []byte(`{"key": "value"}`), defaultPermissions)
+
+		if _, err := Verify(o, VerifyOptions{Repair: true}); err != nil {
+			t.Fatalf("Cannot repair overlay: %v", err)
+		}
+		for name, want := range map[string]string{"File 1": "text/x-custom", "untracked": "application/json"} {
+			if md := o.GetMetadata([]string{name})[0]; md == nil || md.Mime != want {
+				t.Errorf("Expected %s to have mime type %q, but got %v", name, want, md)
+			}
+		}
+	})
+
+	t.Run("Repair keeps files changed after the check", func(t *testing.T) {
+		o, root := newOverlay(t)
+		os.Remove(filepath.Join(root, "644fe258_File_1"))
+		os.WriteFile(filepath.Join(root, "674fe711_File_2"), []byte("Changed"), defaultPermissions)
+		changing := &changingOverlay{localOverlay: o.(*localOverlay), change: func() {
+			writeOverlayFile(o, "File 1", []byte("New 1"))
+			writeOverlayFile(o, "File 2", []byte("New 2"))
+		}}
+
+		report, err := Verify(changing, VerifyOptions{Repair: true})
+		if err != nil || !reflect.DeepEqual(report.Missing, []string{"File 1"}) || !reflect.DeepEqual(report.Corrupted, []string{"File 2"}) {
+			t.Errorf("Expected missing and corrupted files, but got %v, %v", report, err)
+		}
+		for name, want := range map[string]string{"File 1": "New 1", "File 2": "New 2"} {
+			if data, err := readOverlayFile(o, name); err != nil || string(data) != want {
+				t.Errorf("Expected %s to keep the new content %q, but got %q, %v", name, want, data, err)
+			}
+		}
+		if report, err := Verify(o, VerifyOptions{}); err != nil || !report.IsClean() {
+			t.Errorf("Expected overlay to be clean, but got %v, %v", report, err)
+		}
+	})
+
+	t.Run("Unreadable files are kept", func(t *testing.T) {
+		o, root := newOverlay(t)
+		os.Remove(filepath.Join(root, "644fe258_File_1"))
+		os.Mkdir(filepath.Join(root, "644fe258_File_1"), defaultDirPermissions)
+
+		report, err := Verify(o, VerifyOptions{Repair: true})
+		if err != nil || !reflect.DeepEqual(report.Unreadable, []string{"File 1"}) || len(report.Missing) != 0 || report.IsClean() {
+			t.Errorf("Expected unreadable file, but got %v, %v", report, err)
+		}
+		if _, err := GC(o, GCOptions{}); err != nil {
+			t.Errorf("Cannot collect garbage: %v", err)
+		}
+		reopened, _ := NewLocalOverlay(root, NewJsonMarshal[OverlayMetadata]())
+		if names := listNames(reopened); !reflect.DeepEqual(names, []string{"File 1", "File 2", "File 3"}) {
+			t.Errorf("Expected unreadable file to stay in the metadata, but got %v", names)
+		}
+		if _, err := os.Stat(filepath.Join(root, "644fe258_File_1")); err != nil {
+			t.Errorf("Expected unreadable local file to be kept, but got %v", err)
+		}
+	})
+
+	t.Run("Memory overlay", func(t *testing.T) {
+		o := NewMemoryOverlay()
+		writeOverlayFile(o, "File 1", []byte("File 1"))
+		if report, err := Verify(o, VerifyOptions{}); err != nil || !report.IsClean() || report.Checked != 1 {
+			t.Errorf("Expected clean report, but got %v, %v", report, err)
+		}
+	})
+}
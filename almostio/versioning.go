@@ -0,0 +1,174 @@
+package almostio
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"time"
+)
+
+// VersionLimits limits the previous versions kept for each file, zero values mean no limit. The
+// current version is always kept.
+type VersionLimits struct {
+	// MaxVersions is the number of previous versions to keep.
+	MaxVersions int
+	// MaxAge removes the versions written earlier than that.
+	MaxAge time.Duration
+}
+
+// VersionedOverlay keeps previous versions of the overwritten files, Delete removes all of them.
+type VersionedOverlay interface {
+	Overlay
+
+	// Versions returns the metadata of all versions of the file from the oldest one to the
+	// current one, nil if there is no such file.
+	Versions(name string) []*FileMetadata
+	// OpenVersion opens the given version of the file for reading, returns os.ErrNotExist if
+	// there is no such version.
+	OpenVersion(name string, version int) (io.ReadCloser, error)
+	// PruneVersions removes the previous versions of all files over the limits.
+	PruneVersions(limits VersionLimits) error
+}
+
+// WithVersioning keeps the overwritten content as a previous version of the file, unless the
+// sha256 did not change or the file was incomplete. The versions over the limits are removed on
+// every write.
+func WithVersioning(limits VersionLimits) LocalOverlayOption {
+	return func(lo *localOverlay) {
+		lo.versioning = &limits
+	}
+}
+
+// prune drops the oldest versions over the limits.
+func (vl *VersionLimits) prune(versions []*FileMetadata, now time.Time) []*FileMetadata {
+	result := []*FileMetadata{}
+	for i, version := range versions {
+		if vl.MaxVersions > 0 && len(versions)-i > vl.MaxVersions {
+			continue
+		}
+		if vl.MaxAge > 0 && now.Sub(version.Modified) > vl.MaxAge {
+			continue
+		}
+		result = append(result, version)
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+// localNames returns the local files of the entry and its previous versions.
+func localNames(md *FileMetadata) []string {
+	result := []string{md.LocalName}
+	for _, version := range md.Versions {
+		result = append(result, version.LocalName)
+	}
+	return result
+}
+
+// entrySize returns the size of the entry with all its versions.
+func entrySize(md *FileMetadata) int64 {
+	size := md.Size
+	for _, version := range md.Versions {
+		size += version.Size
+	}
+	return size
+}
+
+// addVersion makes the overwritten entry a previous version of the new one. If the new content
+// takes the local file of the old one, returns the new local name for the old file, the caller
+// moves it there. The lock must be held by the caller.
+func (lo *localOverlay) addVersion(fmd *FileMetadata, old *FileMetadata) string {
+	if lo.versioning == nil {
+		return ""
+	}
+	if old == nil {
+		fmd.Version = 1
+		return ""
+	}
+	fmd.Version = old.Version
+	fmd.Versions = old.Versions
+	// Incomplete content is not worth keeping, e.g. the parts of a resumed download
+	if old.Incomplete || (old.Sha256 == fmd.Sha256 && old.Codec == fmd.Codec) {
+		return ""
+	}
+
+	previous := *old
+	previous.Versions = nil
+	aside := ""
+	if !lo.contentAddressed && old.LocalName == fmd.LocalName {
+		previous.LocalName = lo.versionLocalName(old)
+		aside = previous.LocalName
+	}
+	fmd.Version = old.Version + 1
+	fmd.Versions = lo.versioning.prune(append(slices.Clone(old.Versions), &previous), lo.now())
+	return aside
+}
+
+// versionLocalName returns an unused local name for the previous version of the entry. Renamed files
+// keep the local names of their versions, so the name derived from the version could be taken.
+func (lo *localOverlay) versionLocalName(md *FileMetadata) string {
+	localName := fmt.Sprintf("%s~%d", md.LocalName, md.Version)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(lo.resolve(localName)); lo.refs[localName] == 0 && os.IsNotExist(err) {
+			return localName
+		}
+		localName = fmt.Sprintf("%s~%d.%d", md.LocalName, md.Version, i)
+	}
+}
+
+func (lo *localOverlay) Versions(name string) []*FileMetadata {
+	lo.lock.RLock()
+	defer lo.lock.RUnlock()
+
+	md, ok := lo.metadata.FileMetadata[name]
+	if !ok {
+		return nil
+	}
+	return append(slices.Clone(md.Versions), lo.withAccessTime(md))
+}
+
+func (lo *localOverlay) OpenVersion(name string, version int) (io.ReadCloser, error) {
+	lo.lock.RLock()
+	defer lo.lock.RUnlock()
+
+	md, ok := lo.metadata.FileMetadata[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	for _, candidate := range append(slices.Clone(md.Versions), md) {
+		if candidate.Version == version {
+			f, err := os.Open(lo.resolve(candidate.LocalName))
+			if err != nil {
+				return nil, err
+			}
+			return lo.decode(f, candidate)
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+func (lo *localOverlay) PruneVersions(limits VersionLimits) error {
+	lo.lock.Lock()
+	defer lo.lock.Unlock()
+
+	now := lo.now()
+	pruned := []*FileMetadata{}
+	unused := []string{}
+	for _, md := range lo.metadata.FileMetadata {
+		if versions := limits.prune(md.Versions, now); len(versions) != len(md.Versions) {
+			pruned = append(pruned, md)
+			updated := *md
+			updated.Versions = versions
+			unused = append(unused, lo.setEntry(md.Name, &updated)...)
+		}
+	}
+	if err := lo.writeMetadata(); err != nil {
+		for _, md := range pruned {
+			lo.setEntry(md.Name, md)
+		}
+		return err
+	}
+	return lo.removeUnused(unused)
+}
@@ -0,0 +1,195 @@
+package almostio
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func readVersion(o VersionedOverlay, name string, version int) (string, error) {
+	r, err := o.OpenVersion(name, version)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	return string(data), err
+}
+
+func versionNumbers(versions []*FileMetadata) []int {
+	result := []int{}
+	for _, md := range versions {
+		result = append(result, md.Version)
+	}
+	return result
+}
+
+func TestVersioning(t *testing.T) {
+
+	t.Run("Writes create versions", func(t *testing.T) {
+		root := filepath.Join(t.TempDir(), "overlay_root")
+		clock := newFakeClock()
+		o := newTestOverlay(t, root, withClock(clock), WithVersioning(VersionLimits{}))
+		for _, content := range []string{"one", "two", "two", "three"} {
+			writeOverlayFile(o, "File", []byte(content))
+			clock.Advance(time.Hour)
+		}
+
+		versions := o.Versions("File")
+		if numbers := versionNumbers(versions); !reflect.DeepEqual(numbers, []int{1, 2, 3}) {
+			t.Errorf("Expected versions without unchanged content, but got %v", numbers)
+		}
+		for i, content := range []string{"one", "two", "three"} {
+			if got, err := readVersion(o, "File", i+1); err != nil || got != content {
+				t.Errorf("Expected version %d to be %q, but got %q, %v", i+1, content, got, err)
+			}
+		}
+		if got := must(readOverlayFile(o, "File")); string(got) != "three" {
+			t.Errorf("Expected current version, but got %q", got)
+		}
+		if _, err := o.OpenVersion("File", 4); !os.IsNotExist(err) {
+			t.Errorf("Expected missing version, but got %v", err)
+		}
+
+		o = newTestOverlay(t, root, WithVersioning(VersionLimits{}))
+		if got, err := readVersion(o, "File", 1); err != nil || got != "one" {
+			t.Errorf("Expected versions to be saved, but got %q, %v", got, err)
+		}
+		if report := must(Verify(o, VerifyOptions{})); !report.IsClean() {
+			t.Errorf("Expected version files not to be orphans, but got %v", report)
+		}
+
+		o.Delete("File")
+		if files := allLocalFiles(t, root); len(files) != 0 {
+			t.Errorf("Expected delete to remove all versions, but got %v", files)
+		}
+	})
+
+	t.Run("Renamed file keeps versions", func(t *testing.T) {
+		root := filepath.Join(t.TempDir(), "overlay_root")
+		o := newTestOverlay(t, root, WithVersioning(VersionLimits{}))
+		writeOverlayFile(o, "a", []byte("old-v1"))
+		writeOverlayFile(o, "a", []byte("old-v2"))
+		if err := o.Rename("a", "b"); err != nil {
+			t.Fatalf("Cannot rename file: %v", err)
+		}
+		writeOverlayFile(o, "a", []byte("new-v1"))
+		writeOverlayFile(o, "a", []byte("new-v2"))
+
+		for _, tc := range []struct {
+			name    string
+			version int
+			want    string
+		}{
+			{"b", 1, "old-v1"}, {"b", 2, "old-v2"}, {"a", 1, "new-v1"}, {"a", 2, "new-v2"},
+		} {
+			if got, err := readVersion(o, tc.name, tc.version); err != nil || got != tc.want {
+				t.Errorf("Expected version %d of %s to be %q, but got %q, %v", tc.version, tc.name, tc.want, got, err)
+			}
+		}
+		if report := must(Verify(o, VerifyOptions{})); !report.IsClean() {
+			t.Errorf("Expected consistent overlay, but got %v", report)
+		}
+	})
+
+	t.Run("Content addressed versions", func(t *testing.T) {
+		root := filepath.Join(t.TempDir(), "overlay_root")
+		o := newTestOverlay(t, root, WithContentAddressing(), WithVersioning(VersionLimits{}))
+		writeOverlayFile(o, "File", []byte("one"))
+		writeOverlayFile(o, "Other", []byte("two"))
+		writeOverlayFile(o, "File", []byte("two"))
+
+		if got, err := readVersion(o, "File", 1); err != nil || got != "one" {
+			t.Errorf("Expected first version, but got %q, %v", got, err)
+		}
+		if files := allLocalFiles(t, root); len(files) != 2 {
+			t.Errorf("Expected versions to share local files, but got %v", files)
+		}
+	})
+
+	t.Run("Limits are applied on write", func(t *testing.T) {
+		root := filepath.Join(t.TempDir(), "overlay_root")
+		clock := newFakeClock()
+		o := newTestOverlay(t, root, withClock(clock), WithVersioning(VersionLimits{MaxVersions: 2}))
+		for _, content := range []string{"one", "two", "three", "four"} {
+			writeOverlayFile(o, "File", []byte(content))
+			clock.Advance(time.Hour)
+		}
+
+		if numbers := versionNumbers(o.Versions("File")); !reflect.DeepEqual(numbers, []int{2, 3, 4}) {
+			t.Errorf("Expected two previous versions, but got %v", numbers)
+		}
+		if files := allLocalFiles(t, root); len(files) != 3 {
+			t.Errorf("Expected pruned version files to be removed, but got %v", files)
+		}
+	})
+
+	t.Run("Versions over max bytes are pruned", func(t *testing.T) {
+		root := filepath.Join(t.TempDir(), "overlay_root")
+		clock := newFakeClock()
+		o := newTestOverlay(t, root, withClock(clock), WithVersioning(VersionLimits{}), WithEviction(EvictionPolicy{MaxBytes: 10}))
+		for _, content := range []string{"one", "12345678", "abcdefgh"} {
+			if err := writeOverlayFile(o, "File", []byte(content)); err != nil {
+				t.Errorf("Cannot write %q: %v", content, err)
+			}
+			clock.Advance(time.Hour)
+		}
+
+		if got, err := readOverlayFile(o, "File"); err != nil || string(got) != "abcdefgh" {
+			t.Errorf("Expected written file to be kept, but got %q, %v", got, err)
+		}
+		if numbers := versionNumbers(o.Versions("File")); !reflect.DeepEqual(numbers, []int{3}) {
+			t.Errorf("Expected previous versions to be pruned, but got %v", numbers)
+		}
+		if files := allLocalFiles(t, root); len(files) != 1 {
+			t.Errorf("Expected pruned version files to be removed, but got %v", files)
+		}
+	})
+
+	t.Run("Prune by age", func(t *testing.T) {
+		clock := newFakeClock()
+		o := newTestOverlay(t, "", withClock(clock), WithVersioning(VersionLimits{}))
+		for _, content := range []string{"one", "two", "three"} {
+			writeOverlayFile(o, "File", []byte(content))
+			clock.Advance(time.Hour)
+		}
+
+		if err := o.PruneVersions(VersionLimits{MaxAge: 150 * time.Minute}); err != nil {
+			t.Errorf("Cannot prune versions: %v", err)
+		}
+		if numbers := versionNumbers(o.Versions("File")); !reflect.DeepEqual(numbers, []int{2, 3}) {
+			t.Errorf("Expected old versions to be removed, but got %v", numbers)
+		}
+		o.PruneVersions(VersionLimits{MaxVersions: -1, MaxAge: time.Nanosecond})
+		if numbers := versionNumbers(o.Versions("File")); !reflect.DeepEqual(numbers, []int{3}) {
+			t.Errorf("Expected only current version, but got %v", numbers)
+		}
+	})
+
+	t.Run("Appending does not create versions", func(t *testing.T) {
+		o := newTestOverlay(t, "", WithVersioning(VersionLimits{}))
+		writeOverlayFile(o, "File", []byte("old"))
+		for _, part := range []string{"new", " content"} {
+			w := must(o.OpenAppend("File"))
+			w.Write([]byte(part))
+			w.Close()
+		}
+
+		if numbers := versionNumbers(o.Versions("File")); !reflect.DeepEqual(numbers, []int{1, 2}) {
+			t.Errorf("Expected single version for appended content, but got %v", numbers)
+		}
+	})
+
+	t.Run("Without versioning", func(t *testing.T) {
+		o := newTestOverlay(t, "")
+		writeOverlayFile(o, "File", []byte("one"))
+		writeOverlayFile(o, "File", []byte("two"))
+
+		if numbers := versionNumbers(o.Versions("File")); !reflect.DeepEqual(numbers, []int{0}) {
+			t.Errorf("Expected only current version, but got %v", numbers)
+		}
+	})
+}
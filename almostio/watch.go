@@ -0,0 +1,155 @@
+package almostio
+
+import (
+	"strings"
+	"sync"
+)
+
+// watchBufferSize is the number of events kept for a watcher that does not read them.
+const watchBufferSize = 256
+
+// EventType is the kind of the change in the overlay.
+type EventType int
+
+const (
+	// EventCreated is sent when a new file is written or renamed.
+	EventCreated EventType = iota
+	// EventUpdated is sent when the file content or metadata changes, except the access time.
+	EventUpdated
+	// EventDeleted is sent when the file is deleted or renamed.
+	EventDeleted
+	// EventEvicted is sent when the file is removed by the eviction policy.
+	EventEvicted
+	// EventOverflow is sent when some events were dropped because the buffer was full, the watcher
+	// should list the files again to catch up.
+	EventOverflow
+)
+
+func (et EventType) String() string {
+	switch et {
+	case EventCreated:
+		return "created"
+	case EventUpdated:
+		return "updated"
+	case EventDeleted:
+		return "deleted"
+	case EventEvicted:
+		return "evicted"
+	case EventOverflow:
+		return "overflow"
+	}
+	return "unknown"
+}
+
+// Event is a single change in the overlay.
+type Event struct {
+	Type EventType
+	// Metadata is the new metadata for the created and updated files, the last known metadata for
+	// the deleted and evicted ones and nil for the overflow.
+	Metadata *FileMetadata
+}
+
+// Watcher receives the changes of the files with the given prefix. Events are buffered and
+// dropped when the buffer is full, so a slow reader does not block the overlay.
+type Watcher struct {
+	// Events are the changes in the order they happened, closed after Close.
+	Events <-chan Event
+
+	lock     sync.Mutex
+	events   chan Event
+	prefix   string
+	closed   bool
+	overflow bool
+	onClose  func()
+}
+
+func newWatcher(prefix string, onClose func()) *Watcher {
+	events := make(chan Event, watchBufferSize)
+	return &Watcher{
+		Events:  events,
+		events:  events,
+		prefix:  prefix,
+		onClose: onClose,
+	}
+}
+
+// send delivers the event without blocking, sends EventOverflow first if events were dropped.
+func (w *Watcher) send(event Event) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.closed || (event.Metadata != nil && !strings.HasPrefix(event.Metadata.Name, w.prefix)) {
+		return
+	}
+	if w.overflow {
+		select {
+		case w.events <- Event{Type: EventOverflow}:
+			w.overflow = false
+		default:
+			return
+		}
+	}
+	select {
+	case w.events <- event:
+	default:
+		w.overflow = true
+	}
+}
+
+// Close unsubscribes the watcher and closes the Events channel, safe to call several times.
+func (w *Watcher) Close() {
+	w.lock.Lock()
+	if w.closed {
+		w.lock.Unlock()
+		return
+	}
+	w.closed = true
+	close(w.events)
+	w.lock.Unlock()
+
+	if w.onClose != nil {
+		w.onClose()
+	}
+}
+
+// watchers keeps the subscriptions of an overlay, the zero value is ready to use.
+type watchers struct {
+	lock     sync.Mutex
+	watchers map[*Watcher]bool
+}
+
+func (ws *watchers) watch(prefix string) *Watcher {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+
+	var w *Watcher
+	w = newWatcher(prefix, func() {
+		ws.lock.Lock()
+		defer ws.lock.Unlock()
+		delete(ws.watchers, w)
+	})
+	if ws.watchers == nil {
+		ws.watchers = map[*Watcher]bool{}
+	}
+	ws.watchers[w] = true
+	return w
+}
+
+func (ws *watchers) notify(events ...Event) {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+
+	for w := range ws.watchers {
+		for _, event := range events {
+			w.send(event)
+		}
+	}
+}
+
+// changeEvent returns the event for replacing the old metadata with the new one.
+func changeEvent(old *FileMetadata, md *FileMetadata) Event {
+	if old == nil {
+		return Event{Type: EventCreated, Metadata: md}
+	}
+	return Event{Type: EventUpdated, Metadata: md}
+}
@@ -0,0 +1,156 @@
+package almostio
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// pendingEvents returns the buffered events as "type name" strings.
+func pendingEvents(w *Watcher) []string {
+	result := []string{}
+	for {
+		select {
+		case event := <-w.Events:
+			result = append(result, eventString(event))
+		default:
+			return result
+		}
+	}
+}
+
+func eventString(event Event) string {
+	if event.Metadata == nil {
+		return event.Type.String()
+	}
+	return fmt.Sprintf("%s %s", event.Type, event.Metadata.Name)
+}
+
+// waitEvents reads the given number of events, failing after a timeout.
+func waitEvents(t *testing.T, w *Watcher, count int) []string {
+	result := []string{}
+	for len(result) < count {
+		select {
+		case event := <-w.Events:
+			result = append(result, eventString(event))
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %d events, but got %v", count, result)
+		}
+	}
+	return result
+}
+
+func TestWatch(t *testing.T) {
+	overlays := map[string]func(t *testing.T) Overlay{
+		"local": func(t *testing.T) Overlay {
+			return must(NewLocalOverlay(filepath.Join(t.TempDir(), "overlay_root"), NewJsonMarshal[OverlayMetadata]()))
+		},
+		"memory": func(t *testing.T) Overlay {
+			return NewMemoryOverlay()
+		},
+	}
+	for name, newOverlay := range overlays {
+		t.Run("Events for "+name, func(t *testing.T) {
+			o := newOverlay(t)
+			w := o.Watch("dir/")
+			defer w.Close()
+
+			writeOverlayFile(o, "dir/file", []byte{1})
+			writeOverlayFile(o, "other", []byte{1})
+			writeOverlayFile(o, "dir/file", []byte{2})
+			readOverlayFile(o, "dir/file")
+			o.SetAttributes("dir/file", map[string]string{"key": "value"})
+			o.Rename("dir/file", "dir/renamed")
+			o.Rename("other", "dir/other")
+			o.Delete("dir/renamed")
+
+			if events := pendingEvents(w); !reflect.DeepEqual(events, []string{
+				"created dir/file",
+				"updated dir/file",
+				"updated dir/file",
+				"deleted dir/file",
+				"created dir/renamed",
+				"created dir/other",
+				"deleted dir/renamed",
+			}) {
+				t.Errorf("Unexpected events: %v", events)
+			}
+		})
+	}
+
+	t.Run("Eviction events", func(t *testing.T) {
+		clock := newFakeClock()
+		o := newTestOverlay(t, "", withClock(clock), WithEviction(EvictionPolicy{MaxEntries: 1}))
+		w := o.Watch("")
+		defer w.Close()
+
+		writeOverlayFile(o, "File 1", []byte{1})
+		clock.Advance(time.Second)
+		writeOverlayFile(o, "File 2", []byte{2})
+		if events := pendingEvents(w); !reflect.DeepEqual(events, []string{
+			"created File 1", "created File 2", "evicted File 1",
+		}) {
+			t.Errorf("Unexpected events: %v", events)
+		}
+	})
+
+	t.Run("Overflow drops events", func(t *testing.T) {
+		o := NewMemoryOverlay()
+		w := o.Watch("")
+		defer w.Close()
+
+		for i := range watchBufferSize + 10 {
+			writeOverlayFile(o, fmt.Sprintf("File %d", i), []byte{1})
+		}
+		if events := pendingEvents(w); len(events) != watchBufferSize {
+			t.Errorf("Expected %d buffered events, but got %d", watchBufferSize, len(events))
+		}
+		writeOverlayFile(o, "Last", []byte{1})
+		if events := pendingEvents(w); !reflect.DeepEqual(events, []string{"overflow", "created Last"}) {
+			t.Errorf("Expected overflow event before the new one, but got %v", events)
+		}
+	})
+
+	t.Run("Close unsubscribes", func(t *testing.T) {
+		o := NewMemoryOverlay()
+		w := o.Watch("")
+		w.Close()
+		w.Close()
+		writeOverlayFile(o, "File", []byte{1})
+
+		if _, ok := <-w.Events; ok {
+			t.Errorf("Expected closed channel")
+		}
+		if len(o.watchers.watchers) != 0 {
+			t.Errorf("Expected watcher to be removed")
+		}
+	})
+
+	t.Run("Union overlay events", func(t *testing.T) {
+		upper, middle, lower := newUnionLayers(t)
+		o := NewUnionOverlay(upper, middle, lower)
+		w := o.Watch("")
+
+		writeOverlayFile(o, "New", []byte("new"))
+		writeOverlayFile(o, "Shared", []byte("upper"))
+		o.Delete("Shared")
+		o.Delete("Lower")
+		if events := waitEvents(t, w, 4); !reflect.DeepEqual(events, []string{
+			"created New", "updated Shared", "deleted Shared", "deleted Lower",
+		}) {
+			t.Errorf("Unexpected events: %v", events)
+		}
+
+		upper.Delete("Lower")
+		if events := waitEvents(t, w, 1); !reflect.DeepEqual(events, []string{"created Lower"}) {
+			t.Errorf("Expected removed whiteout to show the lower file, but got %v", events)
+		}
+
+		w.Close()
+		if len(upper.watchers.watchers) != 0 {
+			t.Errorf("Expected upper layer watcher to be removed")
+		}
+	})
+}